@@ -0,0 +1,67 @@
+package dnsproxy
+
+import (
+	"github.com/pkg/errors"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"net"
+)
+
+// ACLGroup is a group of clients by CIDR, see Server.ACL.
+type ACLGroup struct {
+	Name string
+	Nets []*net.IPNet
+	// clients of the group are refused
+	Deny bool
+	// replaces RootResolver for the group, optional
+	Root Resolver
+}
+
+func (g *ACLGroup) contains(ip net.IP) bool {
+	for _, n := range g.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRList parses a list like ["10.0.0.0/8", "::1"], a bare ip is a single host.
+func ParseCIDRList(list []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad cidr: %q", s)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// matchACL finds the group of ip, the first match wins.
+// clients not in any group are refused if there is an allow group.
+// returns false if refused, the group is nil if not matched.
+func matchACL(acl []*ACLGroup, ip net.IP) (*ACLGroup, bool) {
+	hasAllow := false
+	for _, g := range acl {
+		if ip != nil && g.contains(ip) {
+			return g, !g.Deny
+		}
+		hasAllow = hasAllow || !g.Deny
+	}
+	return nil, !hasAllow
+}
+
+func refusedReply(req *dm.Message) *dm.Message {
+	res := errReply(req)
+	res.RCode = dm.RCodeRefused
+	return res
+}
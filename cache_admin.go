@@ -0,0 +1,192 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"github.com/account-login/ctxlog"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CacheAdminHandler serves the cache admin api under /debug/cache/
+//
+//	GET  /debug/cache/                           caches and counters
+//	GET  /debug/cache/entries?cache=NAME         entries with remaining TTL
+//	GET  /debug/cache/lookup?cache=NAME&key=KEY  one entry and its reply
+//	POST /debug/cache/flush?cache=NAME[&suffix=example.com]
+type CacheAdminHandler struct {
+	Server *Server
+}
+
+type cacheEntryInfo struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	// remaining seconds, negative if stale
+	TTL   int64  `json:"ttl"`
+	Hits  uint32 `json:"hits"`
+	Size  int64  `json:"size"`
+	Reply string `json:"reply,omitempty"`
+}
+
+// the query name of packed reply, lower cased
+func replyName(data []byte) string {
+	p := dm.Parser{}
+	if _, err := p.Start(data); err != nil {
+		return ""
+	}
+	q, err := p.Question()
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(q.Name.String())
+}
+
+// with lock
+func (r *CacheResolver) entryInfo(item *cacheItem, nowNs int64) cacheEntryInfo {
+	return cacheEntryInfo{
+		Key:  item.key,
+		Name: replyName(item.data),
+		TTL:  (item.expireNs - nowNs) / 1e9,
+		Hits: item.hits,
+		Size: item.size,
+	}
+}
+
+// entries from the most recently used
+func (r *CacheResolver) entries() []cacheEntryInfo {
+	nowNs := time.Now().UnixNano()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]cacheEntryInfo, 0, r.lru.Len())
+	for e := r.lru.Front(); e != nil; e = e.Next() {
+		out = append(out, r.entryInfo(e.Value.(*cacheItem), nowNs))
+	}
+	return out
+}
+
+func (r *CacheResolver) lookupKey(key string) (cacheEntryInfo, bool) {
+	nowNs := time.Now().UnixNano()
+	r.mu.Lock()
+	item := r.cache[key]
+	if item == nil {
+		r.mu.Unlock()
+		return cacheEntryInfo{}, false
+	}
+	info := r.entryInfo(item, nowNs)
+	data := item.data
+	r.mu.Unlock()
+
+	res := dm.Message{}
+	if err := res.Unpack(data); err == nil {
+		info.Reply = ReprMessageShort(&res)
+	}
+	return info, true
+}
+
+// flush removes entries under suffix, or all entries if suffix is empty.
+func (r *CacheResolver) flush(suffix string) int {
+	suffix = strings.ToLower(strings.TrimSuffix(suffix, "."))
+	if suffix != "" {
+		suffix += "."
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for e := r.lru.Front(); e != nil; {
+		item := e.Value.(*cacheItem)
+		e = e.Next()
+		name := replyName(item.data)
+		if suffix == "" || name == suffix || strings.HasSuffix(name, "."+suffix) {
+			r.remove(item)
+			n++
+		}
+	}
+	r.updateStats()
+	return n
+}
+
+// counters of the cache in Stats
+func (r *CacheResolver) counters() map[string]json.RawMessage {
+	prefix := "cache." + r.Name + "."
+	out := map[string]json.RawMessage{}
+	Stats.Do(func(kv expvar.KeyValue) {
+		if strings.HasPrefix(kv.Key, prefix) {
+			out[strings.TrimPrefix(kv.Key, prefix)] = json.RawMessage(kv.Value.String())
+		}
+	})
+	return out
+}
+
+func adminReply(rw http.ResponseWriter, status int, obj interface{}) {
+	data, _ := json.MarshalIndent(obj, "", "  ")
+	data = append(data, '\n')
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, _ = rw.Write(data)
+}
+
+func adminError(rw http.ResponseWriter, status int, msg string) {
+	adminReply(rw, status, map[string]interface{}{"err": -1, "msg": msg})
+}
+
+func (h *CacheAdminHandler) find(name string) *CacheResolver {
+	for _, r := range h.Server.CurrentCaches() {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func (h *CacheAdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ctx := ctxlog.Pushf(req.Context(), "[cache-admin][remote:%v]", req.RemoteAddr)
+	action := strings.TrimPrefix(req.URL.Path, "/debug/cache/")
+
+	// list caches
+	if action == "" {
+		type cacheInfo struct {
+			Name     string                     `json:"name"`
+			Counters map[string]json.RawMessage `json:"counters"`
+		}
+		out := []cacheInfo{}
+		for _, r := range h.Server.CurrentCaches() {
+			out = append(out, cacheInfo{Name: r.Name, Counters: r.counters()})
+		}
+		adminReply(rw, http.StatusOK, out)
+		return
+	}
+
+	query := req.URL.Query()
+	r := h.find(query.Get("cache"))
+	if r == nil {
+		adminError(rw, http.StatusNotFound, "no such cache")
+		return
+	}
+
+	switch action {
+	case "entries":
+		adminReply(rw, http.StatusOK, r.entries())
+	case "lookup":
+		info, ok := r.lookupKey(query.Get("key"))
+		if !ok {
+			adminError(rw, http.StatusNotFound, "no such key")
+			return
+		}
+		adminReply(rw, http.StatusOK, info)
+	case "flush":
+		if req.Method != http.MethodPost {
+			adminError(rw, http.StatusMethodNotAllowed, "POST required")
+			return
+		}
+		n := r.flush(query.Get("suffix"))
+		ctxlog.Infof(ctx, "[cache:%s][suffix:%q] flushed %d entries", r.Name, query.Get("suffix"), n)
+		adminReply(rw, http.StatusOK, map[string]interface{}{"err": 0, "msg": "OK", "flushed": n})
+	default:
+		adminError(rw, http.StatusNotFound, "unknown action")
+	}
+}
@@ -0,0 +1,112 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/account-login/ctxlog"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// the content of cache_file
+type cacheFile struct {
+	// key: resolver name
+	Caches map[string][]cacheFileEntry `json:"caches"`
+}
+
+type cacheFileEntry struct {
+	Key     string `json:"key"`
+	BaseKey string `json:"base_key"`
+	Scope   uint8  `json:"scope,omitempty"`
+	// unix time in ns
+	Expire int64 `json:"expire"`
+	Store  int64 `json:"store"`
+	// packed reply
+	Data []byte `json:"data"`
+}
+
+// dump entries from the least recently used
+func (r *CacheResolver) dump() []cacheFileEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]cacheFileEntry, 0, r.lru.Len())
+	for e := r.lru.Back(); e != nil; e = e.Prev() {
+		item := e.Value.(*cacheItem)
+		entries = append(entries, cacheFileEntry{
+			Key: item.key, BaseKey: item.baseKey, Scope: item.scope,
+			Expire: item.expireNs, Store: item.storeNs, Data: item.data,
+		})
+	}
+	return entries
+}
+
+// restore entries from dump, returns the number of entries not expired
+func (r *CacheResolver) restore(entries []cacheFileEntry) int {
+	nowNs := time.Now().UnixNano()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, e := range entries {
+		if e.Expire+int64(r.StaleWindow) <= nowNs || e.Key == "" || len(e.Data) == 0 {
+			continue
+		}
+		r.insert(&cacheItem{
+			expireNs: e.Expire, storeNs: e.Store, data: e.Data,
+			key: e.Key, baseKey: e.BaseKey, scope: e.Scope,
+		})
+		n++
+	}
+	r.evict()
+	r.updateStats()
+	return n
+}
+
+// SaveCaches writes caches to path, replacing the file atomically.
+func SaveCaches(ctx context.Context, path string, caches []*CacheResolver) error {
+	content := cacheFile{Caches: map[string][]cacheFileEntry{}}
+	for _, r := range caches {
+		content.Caches[r.Name] = r.dump()
+	}
+	data, err := json.Marshal(&content)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := path + fmt.Sprintf(".tmp.pid.%v", os.Getpid())
+	if err = ioutil.WriteFile(tmpFile, data, 0o664); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFile, path); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	ctxlog.Debugf(ctx, "saved %d caches to %v", len(caches), path)
+	return nil
+}
+
+// LoadCaches fills caches with the content of path, expired entries are dropped.
+// it is not an error if path does not exist.
+func LoadCaches(ctx context.Context, path string, caches []*CacheResolver) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	content := cacheFile{}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	for _, r := range caches {
+		n := r.restore(content.Caches[r.Name])
+		ctxlog.Infof(ctx, "[cache:%s] loaded %d entries from %v", r.Name, n, path)
+	}
+	return nil
+}
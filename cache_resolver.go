@@ -2,10 +2,13 @@ package dnsproxy
 
 import (
 	"container/heap"
+	"container/list"
 	"context"
 	"fmt"
 	"github.com/account-login/ctxlog"
 	dm "golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,26 +16,77 @@ import (
 type CacheResolver struct {
 	Child Resolver
 	Name  string
-	// key: type + name
-	cache map[string]cacheItem
+	// limits, 0 for unlimited. the least recently used are evicted.
+	MaxEntries int
+	MaxBytes   int64
+	// cap for NXDOMAIN and NODATA, 0 to disable negative caching
+	MaxNegativeTTL uint32
+	// serve stale, RFC 8767. expired entries are kept for StaleWindow, 0 to disable.
+	// they are answered with StaleTTL if Child fails or is slower than StaleTimeout.
+	StaleWindow  time.Duration
+	StaleTTL     uint32
+	StaleTimeout time.Duration
+	// refresh entries hit at least PrefetchMinHits times in the last PrefetchPercent of TTL,
+	// 0 to disable.
+	PrefetchPercent int
+	PrefetchMinHits uint32
+	// the client subnet prefixes of the "ecs": "client" leaves below, 0 if none.
+	// concurrent misses from different subnets are not merged.
+	ClientV4Prefix uint8
+	ClientV6Prefix uint8
+	// key: type + name, with client subnet if the answer has ECS scope
+	cache map[string]*cacheItem
 	heap  cacheHeap
-	mu    sync.Mutex
+	// most recently used at front
+	lru   list.List
+	bytes int64
+	// key: type + name, the last seen ECS scope
+	ecsScope map[string]*scopeRef
+	mu       sync.Mutex
+	// in-flight misses
+	flight flightGroup
+	// the config type, "cache" or "cn"
+	kind string
 }
 
 type cacheItem struct {
+	// when the first record expires
 	expireNs int64
-	res      dm.Message
+	storeNs  int64
+	// the last refresh of stale or popular entry
+	refreshNs int64
+	hits      uint32
+	// packed reply, unpacked on every hit so that nothing is shared
+	data []byte
+	// private
+	key     string
+	baseKey string // without ECS
+	scope   uint8
+	size    int64
+	heapIdx int
+	elem    *list.Element
 }
 
-type heapItem struct {
-	expireNs int64
-	key      string
+// RFC 8767 section 5
+const (
+	staleRecheckNs        = 30 * 1e9
+	staleRefreshTimeout   = 10 * time.Second
+	defaultStaleTTL       = 30
+	defaultStaleTimeoutMs = 1800
+)
+
+type scopeRef struct {
+	scope uint8
+	refs  int // number of items with ECS key
 }
 
-type cacheHeap []heapItem
+// ordered by expireNs
+type cacheHeap []*cacheItem
 
 func (h *cacheHeap) Push(x interface{}) {
-	*h = append(*h, x.(heapItem))
+	item := x.(*cacheItem)
+	item.heapIdx = len(*h)
+	*h = append(*h, item)
 }
 
 func (h *cacheHeap) Pop() interface{} {
@@ -51,66 +105,404 @@ func (h cacheHeap) Less(i, j int) bool {
 
 func (h cacheHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
+	h[i].heapIdx = i
+	h[j].heapIdx = j
 }
 
 func (r *CacheResolver) GetName() string {
 	return r.Name
 }
 
+// zone transfer, not cacheable. dnsmessage only has TypeAXFR
+const typeIXFR dm.Type = 251
+
 func reqShouldCache(req *dm.Message) bool {
-	if len(req.Questions) != 1 {
+	if len(req.Questions) != 1 || req.OpCode != 0 {
 		return false
 	}
-	typ := req.Questions[0].Type
-	return typ == dm.TypeA || typ == dm.TypeAAAA || typ == dm.TypeALL
+	switch req.Questions[0].Type {
+	case typeIXFR, dm.TypeAXFR, dm.TypeOPT:
+		return false
+	default:
+		return true
+	}
+}
+
+// name, type, class and the DO bit
+func cacheKey(req *dm.Message) string {
+	q := &req.Questions[0]
+	key := fmt.Sprintf("%d:%d:%s", q.Type, q.Class, strings.ToLower(q.Name.String()))
+	if opt := findOPT(req); opt != nil && opt.Header.DNSSECAllowed() {
+		key += ":do"
+	}
+	return key
+}
+
+// append the client subnet to key
+func ecsKey(key string, ip net.IP, scope uint8) string {
+	masked := ip.Mask(net.CIDRMask(int(scope), len(ip)*8))
+	return fmt.Sprintf("%s@%v/%d", key, masked, scope)
+}
+
+// with lock
+func (r *CacheResolver) remove(item *cacheItem) {
+	heap.Remove(&r.heap, item.heapIdx)
+	r.lru.Remove(item.elem)
+	delete(r.cache, item.key)
+	r.bytes -= item.size
+
+	if item.key != item.baseKey {
+		if ref := r.ecsScope[item.baseKey]; ref != nil {
+			ref.refs--
+			if ref.refs <= 0 {
+				delete(r.ecsScope, item.baseKey)
+			}
+		}
+	}
+}
+
+// with lock
+func (r *CacheResolver) updateStats() {
+	statSet("cache."+r.Name+".entries", int64(len(r.cache)))
+	statSet("cache."+r.Name+".bytes", r.bytes)
+}
+
+// with lock
+func (r *CacheResolver) expire(nowNs int64) {
+	// stale entries are kept for a while
+	nowNs -= int64(r.StaleWindow)
+	for len(r.heap) > 0 && r.heap[0].expireNs <= nowNs {
+		r.remove(r.heap[0])
+	}
+}
+
+// with lock
+func (r *CacheResolver) evict() {
+	for r.lru.Len() > 0 &&
+		((r.MaxEntries > 0 && len(r.cache) > r.MaxEntries) || (r.MaxBytes > 0 && r.bytes > r.MaxBytes)) {
+		r.remove(r.lru.Back().Value.(*cacheItem))
+		statAdd("cache."+r.Name+".evictions", 1)
+	}
 }
 
-func (r *CacheResolver) get(req *dm.Message) (cacheItem, bool) {
+// minimal TTL of answers and authorities, OPT excluded
+func minRRTTL(res *dm.Message) (uint32, bool) {
+	ttl, found := uint32(0), false
+	for _, section := range [][]dm.Resource{res.Answers, res.Authorities} {
+		for i := range section {
+			if !found || section[i].Header.TTL < ttl {
+				ttl, found = section[i].Header.TTL, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// decrease the TTL of each record by elapsed seconds
+func ageTTL(res *dm.Message, elapsed uint32) {
+	for _, section := range [][]dm.Resource{res.Answers, res.Authorities, res.Additionals} {
+		for i := range section {
+			h := &section[i].Header
+			if h.Type == dm.TypeOPT {
+				continue // not a TTL
+			}
+			if h.TTL > elapsed {
+				h.TTL -= elapsed
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+}
+
+// copyMessage copies the sections so that TTLs can be modified,
+// bodies are shared since they are never modified in place.
+func copyMessage(m *dm.Message) *dm.Message {
+	c := *m
+	c.Questions = append([]dm.Question(nil), m.Questions...)
+	c.Answers = append([]dm.Resource(nil), m.Answers...)
+	c.Authorities = append([]dm.Resource(nil), m.Authorities...)
+	c.Additionals = append([]dm.Resource(nil), m.Additionals...)
+	return &c
+}
+
+// popular and about to expire
+func (r *CacheResolver) shouldPrefetch(item *cacheItem, nowNs int64) bool {
+	if r.PrefetchPercent <= 0 || item.hits < r.PrefetchMinHits {
+		return false
+	}
+	return (item.expireNs-nowNs)*100 <= (item.expireNs-item.storeNs)*int64(r.PrefetchPercent)
+}
+
+func (r *CacheResolver) get(ctx context.Context, req *dm.Message) (*dm.Message, bool) {
+	res, stale, _ := r.lookup(ctx, req)
+	if res == nil || stale {
+		return nil, false
+	}
+	return res, true
+}
+
+// lookup finds the reply in cache, which may be stale.
+// refresh is true if the caller should refresh the stale or popular entry.
+func (r *CacheResolver) lookup(ctx context.Context, req *dm.Message) (res *dm.Message, stale bool, refresh bool) {
 	nowNs := time.Now().UnixNano()
-	key := fmt.Sprintf("%d:%s", req.Questions[0].Type, req.Questions[0].Name)
+	key := cacheKey(req)
 
 	r.mu.Lock()
 	// expire cache
-	for len(r.heap) > 0 && r.heap[0].expireNs <= nowNs {
-		hi := heap.Pop(&r.heap).(heapItem)
-		delete(r.cache, hi.key)
+	r.expire(nowNs)
+	// get cache, try client subnet first
+	var found *cacheItem
+	if ref := r.ecsScope[key]; ref != nil {
+		if ip := requestSubnetIP(ctx, req); ip != nil {
+			found = r.cache[ecsKey(key, ip, ref.scope)]
+		}
 	}
-	// get cache
-	item, ok := r.cache[key]
+	if found == nil {
+		found = r.cache[key]
+	}
+	var data []byte
+	storeNs := int64(0)
+	if found != nil {
+		r.lru.MoveToFront(found.elem)
+		data, storeNs = found.data, found.storeNs
+		stale = found.expireNs <= nowNs
+		found.hits++
+		// one refresh at a time, and not too often if it fails
+		if (stale || r.shouldPrefetch(found, nowNs)) && nowNs-found.refreshNs >= staleRecheckNs {
+			found.refreshNs = nowNs
+			refresh = true
+		}
+	}
+	if found != nil && !stale {
+		statAdd("cache."+r.Name+".hits", 1)
+	} else {
+		statAdd("cache."+r.Name+".misses", 1)
+	}
+	r.updateStats()
 	r.mu.Unlock()
 
-	// hit
-	if ok {
-		// id
-		item.res.ID = req.ID
-		// update TTL
-		newTTL := (item.expireNs - nowNs) / 1e9
-		for i := range item.res.Answers {
-			item.res.Answers[i].Header.TTL = uint32(newTTL) // FIXME: race
-		}
+	if data == nil {
+		return nil, false, false
 	}
 
-	return item, ok
+	// hit, data is immutable
+	res = &dm.Message{}
+	if err := res.Unpack(data); err != nil {
+		ctxlog.Errorf(ctx, "unpack cached reply: %v", err)
+		return nil, false, false
+	}
+	res.ID = req.ID
+	// the key is case insensitive
+	res.Questions = append([]dm.Question(nil), req.Questions...)
+	ageTTL(res, uint32((nowNs-storeNs)/1e9))
+	return res, stale, refresh
 }
 
-func (r *CacheResolver) set(req *dm.Message, res *dm.Message) {
+// negativeTTL returns the TTL for NXDOMAIN or NODATA by the SOA in authority, RFC 2308.
+// the index of SOA is -1 if res is not a cacheable negative response.
+func negativeTTL(res *dm.Message) (uint32, int) {
+	if res.RCode != dm.RCodeNameError && (res.RCode != dm.RCodeSuccess || len(res.Answers) > 0) {
+		return 0, -1
+	}
+	for i := range res.Authorities {
+		if soa, ok := res.Authorities[i].Body.(*dm.SOAResource); ok {
+			ttl := res.Authorities[i].Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return ttl, i
+		}
+	}
+	return 0, -1 // no SOA, do not know how long
+}
+
+func (r *CacheResolver) set(ctx context.Context, req *dm.Message, res *dm.Message) {
+	if res.Truncated {
+		return // incomplete answer
+	}
+	if rcode := ExtendedRCode(res); rcode != dm.RCodeSuccess && rcode != dm.RCodeNameError {
+		return // server failure etc.
+	}
 	if len(res.Answers) == 0 {
-		return // negative response, or uncommon type. not worth caching
+		if r.MaxNegativeTTL == 0 {
+			return
+		}
+		ttl, soaIdx := negativeTTL(res)
+		if soaIdx < 0 {
+			return
+		}
+		if ttl > r.MaxNegativeTTL {
+			ttl = r.MaxNegativeTTL
+		}
+		// the SOA TTL tells the client how long to cache the negative answer
+		res = copyMessage(res)
+		res.Authorities[soaIdx].Header.TTL = ttl
 	}
 
 	nowNs := time.Now().UnixNano()
-	key := fmt.Sprintf("%d:%s", req.Questions[0].Type, req.Questions[0].Name)
+	baseKey := cacheKey(req)
+	key := baseKey
+
+	// the answer is only for the client subnet if scoped,
+	// unless the subnet does not cover the client, e.g. a fixed ECS for all clients.
+	scope := uint8(0)
+	if ecs := findECS(res); ecs != nil && ecs.ScopePrefix > 0 {
+		ip := requestSubnetIP(ctx, req)
+		subnet := net.IPNet{IP: ecs.IP, Mask: net.CIDRMask(int(ecs.SourcePrefix), len(ecs.IP)*8)}
+		if ip != nil && subnet.Contains(ip) {
+			scope = ecs.ScopePrefix
+			if scope > ecs.SourcePrefix {
+				scope = ecs.SourcePrefix
+			}
+			key = ecsKey(baseKey, ip, scope)
+		}
+	}
 
-	// FIXME: assume TTL is same for all answers
-	expireNs := nowNs + int64(res.Answers[0].Header.TTL)*1e9
+	// expire with the first record
+	ttl, _ := minRRTTL(res)
+	if ttl == 0 {
+		return
+	}
+	expireNs := nowNs + int64(ttl)*1e9
+
+	data, err := res.Pack()
+	if err != nil {
+		ctxlog.Warnf(ctx, "can not cache reply: %v", err)
+		return
+	}
 
 	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.insert(&cacheItem{
+		expireNs: expireNs, storeNs: nowNs, data: data,
+		key: key, baseKey: baseKey, scope: scope,
+	})
+	r.expire(nowNs)
+	r.evict()
+	r.updateStats()
+}
+
+// with lock
+func (r *CacheResolver) insert(newItem *cacheItem) {
+	key, baseKey := newItem.key, newItem.baseKey
+	// rough memory usage
+	size := int64(len(key)+len(newItem.data)) + 128
+
 	if r.cache == nil {
-		r.cache = map[string]cacheItem{}
+		r.cache = map[string]*cacheItem{}
+		r.ecsScope = map[string]*scopeRef{}
+	}
+
+	// replace, no dup in heap
+	if item := r.cache[key]; item != nil {
+		r.bytes += size - item.size
+		item.expireNs = newItem.expireNs
+		item.storeNs = newItem.storeNs
+		item.refreshNs = 0
+		item.hits = 0
+		item.data = newItem.data
+		item.size = size
+		heap.Fix(&r.heap, item.heapIdx)
+		r.lru.MoveToFront(item.elem)
+	} else {
+		item = newItem
+		item.size = size
+		r.cache[key] = item
+		heap.Push(&r.heap, item)
+		item.elem = r.lru.PushFront(item)
+		r.bytes += size
+		if key != baseKey {
+			ref := r.ecsScope[baseKey]
+			if ref == nil {
+				ref = &scopeRef{}
+				r.ecsScope[baseKey] = ref
+			}
+			ref.refs++
+		}
+	}
+	if newItem.scope > 0 {
+		r.ecsScope[baseKey].scope = newItem.scope
+	}
+}
+
+// the reply for stale entry, with a small TTL
+func (r *CacheResolver) staleReply(res *dm.Message) *dm.Message {
+	ttl := r.StaleTTL
+	if ttl == 0 {
+		ttl = defaultStaleTTL
+	}
+	for _, section := range [][]dm.Resource{res.Answers, res.Authorities, res.Additionals} {
+		for i := range section {
+			if section[i].Header.Type != dm.TypeOPT {
+				section[i].Header.TTL = ttl
+			}
+		}
+	}
+	statAdd("cache."+r.Name+".stale", 1)
+	return res
+}
+
+func replyUsable(res *dm.Message, err error) bool {
+	return err == nil && res != nil && res.RCode != dm.RCodeServerFailure && res.RCode != dm.RCodeRefused
+}
+
+// refresh asks Child without the deadline of client, and updates the cache.
+func (r *CacheResolver) refresh(ctx context.Context, req *dm.Message) (*dm.Message, error) {
+	childCtx, cancel := context.WithTimeout(context.Background(), staleRefreshTimeout)
+	defer cancel()
+	childCtx = ctxlog.Push(childCtx, ctxlog.Ctx(ctx))
+	childCtx = WithClientIP(childCtx, ClientIPFromContext(ctx))
+
+	res, err := r.Child.Resolve(childCtx, req)
+	if replyUsable(res, err) {
+		r.set(childCtx, req, res)
+	} else {
+		ctxlog.Warnf(childCtx, "refresh failed: [err:%v] %v", err, ReprMessageShort(res))
+	}
+	return res, err
+}
+
+// resolveStale asks Child in background and answers the stale reply if Child is slow or fails.
+func (r *CacheResolver) resolveStale(ctx context.Context, req *dm.Message, stale *dm.Message) (*dm.Message, error) {
+	type result struct {
+		res *dm.Message
+		err error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		res, err := r.refresh(ctx, req)
+		done <- result{res, err}
+	}()
+
+	timeout := r.StaleTimeout
+	if timeout == 0 {
+		timeout = defaultStaleTimeoutMs * time.Millisecond
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		if replyUsable(result.res, result.err) {
+			return result.res, nil
+		}
+		ctxlog.Debugf(ctx, "serve stale for failure")
+	case <-timer.C:
+		ctxlog.Debugf(ctx, "serve stale for timeout")
+	case <-ctx.Done():
+		ctxlog.Debugf(ctx, "serve stale for %v", ctx.Err())
+	}
+	return r.staleReply(stale), nil
+}
+
+func (r *CacheResolver) prefetch(ctx context.Context, req *dm.Message) {
+	ctxlog.Debugf(ctx, "prefetch")
+	statAdd("cache."+r.Name+".prefetch", 1)
+	if res, err := r.refresh(ctx, req); !replyUsable(res, err) {
+		statAdd("cache."+r.Name+".prefetch_failed", 1)
 	}
-	r.cache[key] = cacheItem{expireNs: expireNs, res: *res}
-	heap.Push(&r.heap, heapItem{expireNs: expireNs, key: key})
-	r.mu.Unlock()
 }
 
 func (r *CacheResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message, error) {
@@ -118,26 +510,38 @@ func (r *CacheResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Messa
 		return r.Child.Resolve(ctx, req)
 	}
 
-	item, ok := r.get(req)
+	cached, stale, refresh := r.lookup(ctx, req)
 
 	// hit
-	if ok {
-		key := fmt.Sprintf("%d:%s", req.Questions[0].Type, req.Questions[0].Name)
-		newTTL := item.res.Answers[0].Header.TTL
+	if cached != nil && !stale {
+		key := cacheKey(req)
+		newTTL, _ := minRRTTL(cached)
 		ctxlog.Debugf(ctx, "cache hit: [key:%s][ttl:%v]", key, newTTL)
-		return &item.res, nil
+		if refresh {
+			go r.prefetch(ctx, req)
+		}
+		return cached, nil
 	}
 
-	// miss
-	res, err := r.Child.Resolve(ctx, req)
-	if err != nil {
-		return res, err
+	// stale
+	if cached != nil {
+		if !refresh {
+			return r.staleReply(cached), nil // refreshing or failed recently
+		}
+		return r.resolveStale(ctx, req, cached)
 	}
 
-	// write cache
-	if len(res.Answers) > 0 && res.Answers[0].Header.TTL > 0 {
-		r.set(req, res)
-	}
+	// miss, concurrent misses share one query
+	key := flightKey(ctx, req, r.ClientV4Prefix, r.ClientV6Prefix)
+	return r.flight.do(ctx, r.Name, key, req, func(ctx context.Context) (*dm.Message, error) {
+		res, err := r.Child.Resolve(ctx, req)
+		if err != nil {
+			return res, err
+		}
 
-	return res, err
+		// write cache
+		r.set(ctx, req, res)
+
+		return res, err
+	})
 }
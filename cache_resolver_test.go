@@ -0,0 +1,175 @@
+package dnsproxy
+
+import (
+	"context"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mkReq(name string, typ dm.Type) *dm.Message {
+	return &dm.Message{
+		Header:    dm.Header{ID: 42, RecursionDesired: true},
+		Questions: []dm.Question{{Name: dm.MustNewName(name), Type: typ, Class: dm.ClassINET}},
+	}
+}
+
+func mkA(req *dm.Message, ip [4]byte, ttl uint32) *dm.Message {
+	return &dm.Message{
+		Header:    dm.Header{ID: req.ID, Response: true, RecursionAvailable: true},
+		Questions: req.Questions,
+		Answers: []dm.Resource{{
+			Header: dm.ResourceHeader{Name: req.Questions[0].Name, Type: dm.TypeA, Class: dm.ClassINET, TTL: ttl},
+			Body:   &dm.AResource{A: ip},
+		}},
+	}
+}
+
+// fnResolver answers with a function
+type fnResolver func(req *dm.Message) *dm.Message
+
+func (f fnResolver) GetName() string {
+	return "fn"
+}
+
+func (f fnResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message, error) {
+	return f(req), nil
+}
+
+// two A records with different TTLs and a NS in authority
+func mkMixedTTL(req *dm.Message) *dm.Message {
+	res := mkA(req, [4]byte{1, 2, 3, 4}, 300)
+	rr := res.Answers[0]
+	rr.Header.TTL = 5
+	rr.Body = &dm.AResource{A: [4]byte{1, 2, 3, 5}}
+	res.Answers = append(res.Answers, rr)
+	res.Authorities = []dm.Resource{{
+		Header: dm.ResourceHeader{Name: req.Questions[0].Name, Type: dm.TypeNS, Class: dm.ClassINET, TTL: 1000},
+		Body:   &dm.NSResource{NS: dm.MustNewName("ns.example.")},
+	}}
+	return res
+}
+
+// pretend the entry of req was stored secs ago
+func ageCache(r *CacheResolver, req *dm.Message, secs int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	item := r.cache[cacheKey(req)]
+	item.storeNs -= secs * 1e9
+	item.expireNs -= secs * 1e9
+}
+
+func TestCacheAgesEachRecord(t *testing.T) {
+	ctx := context.Background()
+	req := mkReq("a.example.", dm.TypeA)
+	r := &CacheResolver{Name: "test", Child: fnResolver(mkMixedTTL)}
+	if _, err := r.Resolve(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	item := r.cache[cacheKey(req)]
+	if item == nil || item.expireNs-item.storeNs != 5e9 {
+		r.mu.Unlock()
+		t.Fatal("should expire with the minimal TTL")
+	}
+	r.mu.Unlock()
+
+	ageCache(r, req, 2)
+	res, ok := r.get(ctx, req)
+	if !ok {
+		t.Fatal("miss")
+	}
+	if ttl := res.Answers[0].Header.TTL; ttl != 298 {
+		t.Errorf("answer 0 ttl: %v", ttl)
+	}
+	if ttl := res.Answers[1].Header.TTL; ttl != 3 {
+		t.Errorf("answer 1 ttl: %v", ttl)
+	}
+	if ttl := res.Authorities[0].Header.TTL; ttl != 998 {
+		t.Errorf("authority ttl: %v", ttl)
+	}
+
+	ageCache(r, req, 4)
+	if _, ok := r.get(ctx, req); ok {
+		t.Fatal("should expire")
+	}
+}
+
+func TestCacheConcurrentHits(t *testing.T) {
+	ctx := context.Background()
+	req := mkReq("a.example.", dm.TypeA)
+	r := &CacheResolver{Name: "test", Child: fnResolver(mkMixedTTL)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if i%10 == 0 {
+					r.set(ctx, req, mkMixedTTL(req))
+					continue
+				}
+				res, err := r.Resolve(ctx, req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(res.Answers) != 2 || res.Answers[1].Header.TTL > 5 {
+					t.Errorf("bad reply: %v", ReprMessageShort(res))
+					return
+				}
+				// the caller owns the reply
+				res.Answers[0].Header.TTL = 0
+				res.Answers[1].Body.(*dm.AResource).A[0] = 9
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	res, ok := r.get(ctx, req)
+	if !ok {
+		t.Fatal("miss")
+	}
+	if res.Answers[0].Header.TTL == 0 || res.Answers[1].Body.(*dm.AResource).A[0] != 1 {
+		t.Fatalf("cache modified by callers: %v", ReprMessageShort(res))
+	}
+}
+
+func TestCNResolverMaxTTL(t *testing.T) {
+	ctx := context.Background()
+	req := mkReq("a.example.", dm.TypeA)
+	r := &CNResolver{Name: "cn", CNList: []Resolver{fnResolver(mkMixedTTL)}, Timeout: time.Second, MaxTTL: 3}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := r.Resolve(ctx, req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, rr := range append(res.Answers, res.Authorities...) {
+				if rr.Header.TTL > 3 {
+					t.Errorf("ttl not capped: %v", ReprMessageShort(res))
+					return
+				}
+			}
+			res.Answers[0].Header.TTL = 77
+		}()
+	}
+	wg.Wait()
+
+	// the cache keeps the original TTLs
+	cached, ok := r.cache.get(ctx, req)
+	if !ok {
+		t.Fatal("miss")
+	}
+	if ttl := cached.Answers[0].Header.TTL; ttl < 299 {
+		t.Fatalf("cached ttl modified: %v", ttl)
+	}
+}
@@ -188,7 +188,7 @@ func CNUpdate(cnctx *CNContext) {
 	shouldAnswer := !alreadyAnswered && (CNHit || noNeedMore || cnctx.timeout)
 	// update cache (maybe after response)
 	if prevIdx != winner {
-		cnctx.r.cache.set(cnctx.req, cnctx.res[winner])
+		cnctx.r.cache.set(ctx, cnctx.req, cnctx.res[winner])
 	}
 	// response
 	if shouldAnswer {
@@ -203,38 +203,30 @@ func CNUpdate(cnctx *CNContext) {
 	)
 }
 
+// fixMaxTTL caps the TTL of each record, res must not be shared.
 func fixMaxTTL(maxTTL uint32, res *dm.Message) uint32 {
-	newTTL := uint32(0)
-	for _, ans := range res.Answers {
-		if ans.Header.TTL > 0 {
-			newTTL = ans.Header.TTL
-			break
-		}
-	}
-
-	if maxTTL == 0 {
-		return newTTL
-	}
-
-	if newTTL > maxTTL {
-		newTTL = maxTTL
-		for i := range res.Answers {
-			res.Answers[i].Header.TTL = newTTL // FIXME: race
+	if maxTTL > 0 {
+		for _, section := range [][]dm.Resource{res.Answers, res.Authorities} {
+			for i := range section {
+				if section[i].Header.TTL > maxTTL {
+					section[i].Header.TTL = maxTTL
+				}
+			}
 		}
 	}
+	newTTL, _ := minRRTTL(res)
 	return newTTL
 }
 
 func (r *CNResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message, error) {
 	// cache
 	if reqShouldCache(req) {
-		item, ok := r.cache.get(req)
+		cached, ok := r.cache.get(ctx, req)
 		// hit
 		if ok {
-			newTTL := fixMaxTTL(r.MaxTTL, &item.res)
-			ctxlog.Debugf(ctx, "cache hit: [key:%d:%s][ttl:%v]",
-				req.Questions[0].Type, req.Questions[0].Name, newTTL)
-			return &item.res, nil
+			newTTL := fixMaxTTL(r.MaxTTL, cached)
+			ctxlog.Debugf(ctx, "cache hit: [key:%s][ttl:%v]", cacheKey(req), newTTL)
+			return cached, nil
 		}
 	}
 
@@ -288,9 +280,13 @@ func (r *CNResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message,
 		CNUpdate(cnctx)
 		cnctx.mu.Unlock()
 	}
+	// still read by CNUpdate of late children
+	cnctx.mu.Lock()
+	defer cnctx.mu.Unlock()
 	if cnctx.idx < 0 {
 		return nil, ErrNoResult // TODO: select a error response
 	}
-	_ = fixMaxTTL(r.MaxTTL, cnctx.res[cnctx.idx])
-	return cnctx.res[cnctx.idx], cnctx.err[cnctx.idx]
+	res := copyMessage(cnctx.res[cnctx.idx])
+	_ = fixMaxTTL(r.MaxTTL, res)
+	return res, cnctx.err[cnctx.idx]
 }
@@ -2,46 +2,213 @@ package dnsproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"github.com/account-login/ctxlog"
 	"github.com/pkg/errors"
 	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	Listen       string
+	Listen       []ListenAddr
 	Timeout      time.Duration
 	RootResolver Resolver
+	// udp payload size for EDNS0
+	EDNSUDPSize int
+	// encrypted listeners, optional
+	DoHListen   string
+	DoTListen   string
+	TLSCertFile string
+	TLSKeyFile  string
+	// caches are saved to CacheFile every CacheSaveInterval and on exit, optional
+	CacheFile         string
+	CacheSaveInterval time.Duration
+	// all caches, including the ones inside CNResolver
+	Caches []*CacheResolver
+	// in-flight queries are abandoned after this on shutdown
+	DrainTimeout time.Duration
+	// tcp and dot clients are closed after idle for this, 0 means 10s, RFC 7766 section 6.2.3
+	TCPIdleTimeout time.Duration
+	// client groups by CIDR, the first match wins, optional
+	ACL []*ACLGroup
+	// per client rate limiting, optional
+	RateLimit *RateLimiter
 	// private
 	UDPResolver
+	dyns []*DynResolver
+	// persistent upstream connections, closed when replaced by Reload
+	tcps []*TCPResolver
+	// *resolverTree, replaced by Reload
+	tree     atomic.Value
+	reloadMu sync.Mutex
+	// serving loops, see server.go
+	stateOnce sync.Once
+	serving   serverState
 }
 
 func MakeServerFromString(input []byte) (*Server, error) {
+	s, err := makeServer(input, nil)
+	if err != nil {
+		return nil, err
+	}
+	startDyns(context.Background(), s.dyns, nil)
+	return s, nil
+}
+
+// start the http servers of dyns not in running
+func startDyns(ctx context.Context, dyns []*DynResolver, running []*DynResolver) {
+	for _, r := range dyns {
+		if containsDyn(running, r) {
+			continue
+		}
+		if err := r.StartHTTP(ctx); err != nil {
+			ctxlog.Errorf(ctx, "DynResolver.StartHTTP() error: %v", err)
+			// ignore err
+		}
+	}
+}
+
+func containsDyn(dyns []*DynResolver, r *DynResolver) bool {
+	for _, d := range dyns {
+		if d == r {
+			return true
+		}
+	}
+	return false
+}
+
+// "listen" is a string or a list of strings, see ParseListenAddr
+func parseListen(raw json.RawMessage) ([]ListenAddr, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		raw = []byte("[" + string(raw) + "]")
+	}
+	var addrs []string
+	if err := json.Unmarshal(raw, &addrs); err != nil {
+		return nil, errors.Wrap(err, "bad listen")
+	}
+
+	var out []ListenAddr
+	for _, addr := range addrs {
+		la, err := ParseListenAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, la)
+	}
+	return out, nil
+}
+
+// prev is the running server when reloading,
+// its upstream sockets and dyn resolvers are reused by the new tree.
+func makeServer(input []byte, prev *Server) (*Server, error) {
 	type jsonResolver struct {
 		Name     string   `json:"name"`
 		Type     string   `json:"type"`
 		Addr     string   `json:"addr"`
 		Child    string   `json:"child"`
 		Children []string `json:"children"`
+		// for RemoteBindedUDPResolver
+		RetransmitMS []int64 `json:"retransmit_ms"`
+		DNS0x20      bool    `json:"dns0x20"`
+		// for leaves: "client", or a fixed subnet like "1.2.3.0/24"
+		ECS         string `json:"ecs"`
+		ECSV4Prefix uint8  `json:"ecs_v4_prefix"`
+		ECSV6Prefix uint8  `json:"ecs_v6_prefix"`
+		// for DoT and DoH
+		TLSServerName string   `json:"tls_server_name"`
+		TLSCAFile     string   `json:"tls_ca_file"`
+		TLSSPKIPins   []string `json:"tls_spki_pins"`
+		// for DoHResolver
+		URL       string `json:"url"`
+		Method    string `json:"method"`
+		Bootstrap string `json:"bootstrap"`
+		// for CacheResolver and CNResolver
+		MaxEntries     int   `json:"max_entries"`
+		MaxBytes       int64 `json:"max_bytes"`
+		MaxNegativeTTL int64 `json:"max_negative_ttl"`
+		// for CacheResolver
+		ServeStale     bool   `json:"serve_stale"`
+		StaleWindowS   int64  `json:"stale_window_s"`
+		StaleTTL       uint32 `json:"stale_ttl"`
+		StaleTimeoutMS int64  `json:"stale_timeout_ms"`
+		// percent of TTL, 0 to disable
+		PrefetchPercent int    `json:"prefetch_percent"`
+		PrefetchMinHits uint32 `json:"prefetch_min_hits"`
 		// for CNResolver
 		CNList []string `json:"cn_list"`
 		AbList []string `json:"ab_list"`
 		MaxTTL uint32   `json:"max_ttl"`
 		// for DynResolver
-		DBPath          string   `json:"db_path"`
-		Suffixes        []string `json:"suffixes"`
-		HTTPAddr        string   `json:"http_addr"`
-		HTTPSAddr       string   `json:"https_addr"`
-		TLSCertFile     string   `json:"tls_cert_file"`
-		TLSKeyFile      string   `json:"tls_key_file"`
-		TLSClientCAFile string   `json:"tls_client_ca_file"`
+		DBPath    string   `json:"db_path"`
+		Suffixes  []string `json:"suffixes"`
+		HTTPAddr  string   `json:"http_addr"`
+		HTTPSAddr string   `json:"https_addr"`
+		// for DynResolver, and the client cert for DoT and DoH
+		TLSCertFile     string `json:"tls_cert_file"`
+		TLSKeyFile      string `json:"tls_key_file"`
+		TLSClientCAFile string `json:"tls_client_ca_file"`
+	}
+	type jsonACLGroup struct {
+		Name  string   `json:"name"`
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+		// root resolver of the group, optional
+		Root string `json:"root"`
+	}
+	type jsonRateLimit struct {
+		// per client ip, burst defaults to 2*qps, at least 1
+		QPS   float64 `json:"qps"`
+		Burst float64 `json:"burst"`
+		// per client /24 or /56 by default
+		PrefixQPS   float64 `json:"prefix_qps"`
+		PrefixBurst float64 `json:"prefix_burst"`
+		V4Prefix    int     `json:"v4_prefix"`
+		V6Prefix    int     `json:"v6_prefix"`
+		// response rate limiting for udp
+		RRLRPS float64 `json:"rrl_rps"`
+		// 0 means 2, negative drops all
+		RRLSlip int      `json:"rrl_slip"`
+		Exempt  []string `json:"exempt"`
+		// max buckets of each kind, 0 means 100000
+		MaxBuckets int `json:"max_buckets"`
 	}
 	type jsonConfig struct {
-		Listen    string         `json:"listen"`
-		TimeoutMS int64          `json:"timeout_ms"`
-		Resolvers []jsonResolver `json:"resolvers"`
-		GFWIPList []string       `json:"gfw_ip_list"`
+		// an address or a list of addresses
+		Listen    json.RawMessage `json:"listen"`
+		TimeoutMS int64           `json:"timeout_ms"`
+		Resolvers []jsonResolver  `json:"resolvers"`
+		GFWIPList []string        `json:"gfw_ip_list"`
+		// number of sockets for upstream udp queries
+		UDPPoolSize int `json:"udp_pool_size"`
+		EDNSUDPSize int `json:"edns_udp_size"`
+		// upstream sockets are moved to new random ports after
+		// this many queries or seconds. 0 means default, negative disables
+		UDPMaxSocketQueries int   `json:"udp_max_socket_queries"`
+		UDPMaxSocketAgeS    int64 `json:"udp_max_socket_age_s"`
+		// DoH and DoT server
+		DoHListen   string `json:"doh_listen"`
+		DoTListen   string `json:"dot_listen"`
+		TLSCertFile string `json:"tls_cert_file"`
+		TLSKeyFile  string `json:"tls_key_file"`
+		// cache persistence
+		CacheFile          string `json:"cache_file"`
+		CacheSaveIntervalS int64  `json:"cache_save_interval_s"`
+		// graceful shutdown
+		DrainTimeoutMS int64 `json:"drain_timeout_ms"`
+		// for tcp and dot clients, including the tls handshake
+		TCPIdleTimeoutMS int64 `json:"tcp_idle_timeout_ms"`
+		// access control
+		ACL       []jsonACLGroup `json:"acl"`
+		RateLimit *jsonRateLimit `json:"rate_limit"`
 	}
 
 	cfg := jsonConfig{}
@@ -51,11 +218,95 @@ func MakeServerFromString(input []byte) (*Server, error) {
 	}
 
 	s := &Server{}
-	s.Listen = cfg.Listen
+	s.Listen, err = parseListen(cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
 	s.Timeout = time.Duration(cfg.TimeoutMS) * time.Millisecond
+	s.UDPResolver.PoolSize = cfg.UDPPoolSize
+	if s.UDPResolver.PoolSize == 0 {
+		s.UDPResolver.PoolSize = 8
+	}
+	s.UDPResolver.MaxSocketQueries = cfg.UDPMaxSocketQueries
+	if s.UDPResolver.MaxSocketQueries == 0 {
+		s.UDPResolver.MaxSocketQueries = 200
+	}
+	s.UDPResolver.MaxSocketAge = time.Duration(cfg.UDPMaxSocketAgeS) * time.Second
+	if cfg.UDPMaxSocketAgeS == 0 {
+		s.UDPResolver.MaxSocketAge = time.Minute
+	}
+	s.EDNSUDPSize = cfg.EDNSUDPSize
+	if s.EDNSUDPSize == 0 {
+		s.EDNSUDPSize = DefaultEDNSUDPSize
+	}
+	if s.EDNSUDPSize < 512 || s.EDNSUDPSize > 65535 {
+		return nil, errors.Errorf("bad edns_udp_size: %v", s.EDNSUDPSize)
+	}
+	s.UDPResolver.EDNSUDPSize = s.EDNSUDPSize
+	s.DoHListen = cfg.DoHListen
+	s.DoTListen = cfg.DoTListen
+	s.TLSCertFile = cfg.TLSCertFile
+	s.TLSKeyFile = cfg.TLSKeyFile
+	if (s.DoHListen != "" || s.DoTListen != "") && (s.TLSCertFile == "" || s.TLSKeyFile == "") {
+		return nil, errors.New("tls_cert_file and tls_key_file are required for doh_listen or dot_listen")
+	}
+	s.CacheFile = cfg.CacheFile
+	s.CacheSaveInterval = time.Duration(cfg.CacheSaveIntervalS) * time.Second
+	if s.CacheSaveInterval <= 0 {
+		s.CacheSaveInterval = 10 * time.Minute
+	}
+	s.DrainTimeout = time.Duration(cfg.DrainTimeoutMS) * time.Millisecond
+	if s.DrainTimeout <= 0 {
+		s.DrainTimeout = 5 * time.Second
+	}
+	s.TCPIdleTimeout = time.Duration(cfg.TCPIdleTimeoutMS) * time.Millisecond
+
+	if jrl := cfg.RateLimit; jrl != nil {
+		rl := &RateLimiter{
+			QPS: jrl.QPS, Burst: jrl.Burst, PrefixQPS: jrl.PrefixQPS, PrefixBurst: jrl.PrefixBurst,
+			V4Prefix: jrl.V4Prefix, V6Prefix: jrl.V6Prefix, RRLRPS: jrl.RRLRPS, RRLSlip: jrl.RRLSlip,
+			MaxBuckets: jrl.MaxBuckets,
+		}
+		if rl.Burst <= 0 {
+			rl.Burst = 2 * rl.QPS
+		}
+		if rl.PrefixBurst <= 0 {
+			rl.PrefixBurst = 2 * rl.PrefixQPS
+		}
+		if rl.V4Prefix == 0 {
+			rl.V4Prefix = 24
+		}
+		if rl.V6Prefix == 0 {
+			rl.V6Prefix = 56
+		}
+		if rl.V4Prefix < 0 || rl.V4Prefix > 32 || rl.V6Prefix < 0 || rl.V6Prefix > 128 {
+			return nil, errors.Errorf("bad rate_limit prefix: /%v /%v", rl.V4Prefix, rl.V6Prefix)
+		}
+		if rl.RRLSlip == 0 {
+			rl.RRLSlip = 2
+		}
+		if rl.RRLSlip < 0 {
+			rl.RRLSlip = 0
+		}
+		rl.Exempt, err = ParseCIDRList(jrl.Exempt)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad rate_limit exempt")
+		}
+		s.RateLimit = rl
+	}
+
+	udp := &s.UDPResolver
+	var prevDyns []*DynResolver
+	if prev != nil {
+		udp = &prev.UDPResolver
+		prevDyns = prev.currentTree().dyns
+	}
 
 	name2resolver := map[string]Resolver{}
 	parents := map[string]struct{}{}
+	// queries are merged by these client subnets if any leaf has "ecs": "client"
+	var clientV4Prefix, clientV6Prefix uint8
+	var flights []*SingleflightResolver
 	var loadResolver func(name string) (Resolver, error)
 	loadResolver = func(name string) (Resolver, error) {
 		// check loaded resolver
@@ -96,6 +347,37 @@ func MakeServerFromString(input []byte) (*Server, error) {
 			return children, nil
 		}
 
+		makeTLSClient := func(defaultServerName string) (*tls.Config, error) {
+			tlsClient := TLSClientConfig{
+				ServerName: jr.TLSServerName,
+				CAFile:     jr.TLSCAFile,
+				SPKIPins:   jr.TLSSPKIPins,
+				CertFile:   jr.TLSCertFile,
+				KeyFile:    jr.TLSKeyFile,
+			}
+			if tlsClient.ServerName == "" {
+				tlsClient.ServerName = defaultServerName
+			}
+			tlsConf, err := tlsClient.Make()
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad tls config for resolver %v", jr)
+			}
+			return tlsConf, nil
+		}
+
+		// cache limits, 100k entries by default, negative for unlimited
+		maxEntries := jr.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = 100000
+		}
+		// 15 minutes by default, negative to disable negative caching
+		maxNegTTL := jr.MaxNegativeTTL
+		if maxNegTTL == 0 {
+			maxNegTTL = 900
+		} else if maxNegTTL < 0 {
+			maxNegTTL = 0
+		}
+
 		var res Resolver
 		switch jr.Type {
 		case "hosts":
@@ -105,12 +387,78 @@ func MakeServerFromString(input []byte) (*Server, error) {
 			if err != nil {
 				return nil, errors.Wrapf(err, "bad addr for resolver %v", jr)
 			}
+			var retransmit []time.Duration
+			for i, ms := range jr.RetransmitMS {
+				delay := time.Duration(ms) * time.Millisecond
+				if delay <= 0 || (i > 0 && delay <= retransmit[i-1]) {
+					return nil, errors.Errorf("retransmit_ms must be increasing for resolver %v", jr)
+				}
+				retransmit = append(retransmit, delay)
+			}
+			// for truncated replies
+			tcp := &TCPResolver{Name: name, Remote: remote.String()}
+			s.tcps = append(s.tcps, tcp)
 			res = &RemoteBindedUDPResolver{
 				Name:        name,
 				Remote:      remote,
-				UDPResolver: &s.UDPResolver,
+				UDPResolver: udp,
+				TCP:         tcp,
+				UDPQueryOptions: UDPQueryOptions{
+					Retransmit: retransmit,
+					Use0x20:    jr.DNS0x20,
+					StatName:   name,
+				},
+			}
+		case "tcp-leaf":
+			if _, err := net.ResolveTCPAddr("tcp", jr.Addr); err != nil {
+				return nil, errors.Wrapf(err, "bad addr for resolver %v", jr)
+			}
+			tcp := &TCPResolver{Name: name, Remote: jr.Addr}
+			s.tcps = append(s.tcps, tcp)
+			res = tcp
+		case "dot":
+			addr := jr.Addr
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "853")
+			}
+			if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+				return nil, errors.Wrapf(err, "bad addr for resolver %v", jr)
+			}
+			host, _, _ := net.SplitHostPort(addr)
+			tlsConf, err := makeTLSClient(host)
+			if err != nil {
+				return nil, err
+			}
+			tcp := &TCPResolver{Name: name, Remote: addr, TLSConfig: tlsConf}
+			s.tcps = append(s.tcps, tcp)
+			res = tcp
+		case "doh":
+			u, err := url.Parse(strings.Replace(jr.URL, "{?dns}", "", 1))
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				return nil, errors.Errorf("bad url for resolver %v", jr)
+			}
+			method := strings.ToUpper(jr.Method)
+			if method == "" {
+				method = http.MethodPost
 			}
-		case "gfw-filter", "cache":
+			if method != http.MethodPost && method != http.MethodGet {
+				return nil, errors.Errorf("bad method for resolver %v", jr)
+			}
+			if jr.Bootstrap != "" && net.ParseIP(jr.Bootstrap) == nil {
+				return nil, errors.Errorf("bad bootstrap ip for resolver %v", jr)
+			}
+			tlsConf, err := makeTLSClient(u.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			res = &DoHResolver{
+				Name:      name,
+				URL:       jr.URL,
+				Method:    method,
+				Bootstrap: jr.Bootstrap,
+				TLSConfig: tlsConf,
+			}
+		case "gfw-filter", "cache", "singleflight":
 			parents[name] = struct{}{}
 			child, err := loadResolver(jr.Child)
 			delete(parents, name)
@@ -126,7 +474,32 @@ func MakeServerFromString(input []byte) (*Server, error) {
 				}
 				res = &resolver
 			case "cache":
-				res = &CacheResolver{Name: name, Child: child}
+				resolver := &CacheResolver{
+					Name: name, Child: child, kind: jr.Type,
+					MaxEntries: maxEntries, MaxBytes: jr.MaxBytes, MaxNegativeTTL: uint32(maxNegTTL),
+					PrefetchPercent: jr.PrefetchPercent, PrefetchMinHits: jr.PrefetchMinHits,
+				}
+				if jr.PrefetchPercent < 0 || jr.PrefetchPercent >= 100 {
+					return nil, errors.Errorf("bad prefetch_percent for resolver %v", jr)
+				}
+				if resolver.PrefetchMinHits == 0 {
+					resolver.PrefetchMinHits = 3
+				}
+				if jr.ServeStale {
+					// 1 day by default
+					resolver.StaleWindow = 24 * time.Hour
+					if jr.StaleWindowS > 0 {
+						resolver.StaleWindow = time.Duration(jr.StaleWindowS) * time.Second
+					}
+					resolver.StaleTTL = jr.StaleTTL
+					resolver.StaleTimeout = time.Duration(jr.StaleTimeoutMS) * time.Millisecond
+				}
+				s.Caches = append(s.Caches, resolver)
+				res = resolver
+			case "singleflight":
+				resolver := &SingleflightResolver{Name: name, Child: child}
+				flights = append(flights, resolver)
+				res = resolver
 			}
 		case "parallel", "chain":
 			children, err := loadChildren(jr.Children)
@@ -157,6 +530,11 @@ func MakeServerFromString(input []byte) (*Server, error) {
 				Timeout: s.Timeout,
 				MaxTTL:  jr.MaxTTL,
 			}
+			resolver.cache = CacheResolver{
+				Name: name, kind: jr.Type,
+				MaxEntries: maxEntries, MaxBytes: jr.MaxBytes, MaxNegativeTTL: uint32(maxNegTTL),
+			}
+			s.Caches = append(s.Caches, &resolver.cache)
 			for _, ipaddr := range cfg.GFWIPList {
 				resolver.AddBlackIP(ipaddr)
 			}
@@ -172,16 +550,57 @@ func MakeServerFromString(input []byte) (*Server, error) {
 				TLSKeyFile:      jr.TLSKeyFile,
 				TLSClientCAFile: jr.TLSClientCAFile,
 			}
-			ctx := context.Background()
-			if err = resolver.StartHTTP(ctx); err != nil {
-				ctxlog.Errorf(ctx, "DynResolver.StartHTTP() error: %v", err)
-				// ignore err
-			}
+			// keep the running one, the http servers can not be started twice
 			res = &resolver
+			for _, prevDyn := range prevDyns {
+				if sameDynConfig(prevDyn, &resolver) {
+					res = prevDyn
+				}
+			}
+			s.dyns = append(s.dyns, res.(*DynResolver))
 		default:
 			return nil, errors.Errorf("unknown resolver: %v", jr)
 		}
 
+		// ECS for leaves
+		if jr.ECS != "" {
+			switch jr.Type {
+			case "leaf", "tcp-leaf", "dot", "doh":
+			default:
+				return nil, errors.Errorf("ecs is only for leaves: %v", jr)
+			}
+
+			resolver := ECSResolver{Name: name, Child: res, V4Prefix: 24, V6Prefix: 56}
+			if jr.ECSV4Prefix > 0 {
+				resolver.V4Prefix = jr.ECSV4Prefix
+			}
+			if jr.ECSV6Prefix > 0 {
+				resolver.V6Prefix = jr.ECSV6Prefix
+			}
+			if resolver.V4Prefix > 32 || resolver.V6Prefix > 128 {
+				return nil, errors.Errorf("bad ecs prefix for resolver %v", jr)
+			}
+			if jr.ECS != "client" {
+				_, subnet, err := net.ParseCIDR(jr.ECS)
+				if err != nil {
+					return nil, errors.Wrapf(err, "bad ecs for resolver %v", jr)
+				}
+				if ip4 := subnet.IP.To4(); ip4 != nil {
+					subnet.IP = ip4
+				}
+				resolver.Subnet = subnet
+			} else {
+				// the finest subnet of all leaves
+				if resolver.V4Prefix > clientV4Prefix {
+					clientV4Prefix = resolver.V4Prefix
+				}
+				if resolver.V6Prefix > clientV6Prefix {
+					clientV6Prefix = resolver.V6Prefix
+				}
+			}
+			res = &resolver
+		}
+
 		// ok
 		name2resolver[name] = res
 		return res, nil
@@ -192,5 +611,36 @@ func MakeServerFromString(input []byte) (*Server, error) {
 		return nil, err
 	}
 
+	for _, jg := range cfg.ACL {
+		if jg.Name == "" {
+			return nil, errors.New("acl group name expected")
+		}
+		if (len(jg.Allow) == 0) == (len(jg.Deny) == 0) {
+			return nil, errors.Errorf("acl group %q: one of allow or deny expected", jg.Name)
+		}
+		group := &ACLGroup{Name: jg.Name, Deny: len(jg.Deny) > 0}
+		group.Nets, err = ParseCIDRList(append(jg.Allow, jg.Deny...))
+		if err != nil {
+			return nil, errors.Wrapf(err, "acl group %q", jg.Name)
+		}
+		if jg.Root != "" {
+			if group.Deny {
+				return nil, errors.Errorf("acl group %q: root is for allow groups", jg.Name)
+			}
+			group.Root, err = loadResolver(jg.Root)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.ACL = append(s.ACL, group)
+	}
+
+	for _, cache := range s.Caches {
+		cache.ClientV4Prefix, cache.ClientV6Prefix = clientV4Prefix, clientV6Prefix
+	}
+	for _, flight := range flights {
+		flight.ClientV4Prefix, flight.ClientV6Prefix = clientV4Prefix, clientV6Prefix
+	}
+
 	return s, nil
 }
@@ -0,0 +1,128 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/account-login/ctxlog"
+	"github.com/pkg/errors"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dohMediaType = "application/dns-message"
+
+// DoHResolver speaks RFC 8484 to an upstream.
+type DoHResolver struct {
+	Name string
+	// uri template, e.g. https://dns.google/dns-query{?dns}
+	URL string
+	// GET or POST, default to POST
+	Method string
+	// connect to this ip instead of resolving the host name in URL, optional
+	Bootstrap string
+	TLSConfig *tls.Config
+	// private
+	once   sync.Once
+	client *http.Client
+	url    string
+}
+
+func (r *DoHResolver) GetName() string {
+	return r.Name
+}
+
+func (r *DoHResolver) init() {
+	// the only variable of RFC 8484 template
+	r.url = strings.Replace(r.URL, "{?dns}", "", 1)
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		TLSClientConfig:     r.TLSConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if r.Bootstrap != "" {
+				_, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				addr = net.JoinHostPort(r.Bootstrap, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	r.client = &http.Client{Transport: transport}
+}
+
+func (r *DoHResolver) newRequest(ctx context.Context, data []byte) (*http.Request, error) {
+	if r.Method == http.MethodGet {
+		sep := "?"
+		if strings.Contains(r.url, "?") {
+			sep = "&"
+		}
+		uri := r.url + sep + "dns=" + base64.RawURLEncoding.EncodeToString(data)
+		return http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	return httpReq, nil
+}
+
+func (r *DoHResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message, error) {
+	ctx = ctxlog.Pushf(ctx, "[DoH:%v]", r.Name)
+	r.once.Do(r.init)
+
+	// ID 0 for http cache friendliness, RFC 8484 section 4.1
+	newReq := *req
+	newReq.ID = 0
+	data, err := newReq.Pack()
+	if err != nil {
+		return nil, errors.Wrap(err, "req.Pack()")
+	}
+
+	httpReq, err := r.newRequest(ctx, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "new http request")
+	}
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	httpRes, err := r.client.Do(httpReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "http")
+	}
+	defer safeClose(ctx, httpRes.Body)
+
+	if httpRes.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("http status: %v", httpRes.Status)
+	}
+	if ct := httpRes.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, errors.Errorf("bad content type: %q", ct)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(httpRes.Body, 64*1024))
+	if err != nil {
+		return nil, errors.Wrap(err, "read body")
+	}
+
+	res := &dm.Message{}
+	if err = res.Unpack(body); err != nil {
+		return nil, errors.Wrap(err, "res.Unpack()")
+	}
+	ctxlog.Debugf(ctx, "[proto:%v] got msg %v", httpRes.Proto, ReprMessageShort(res))
+
+	res.ID = req.ID
+	return res, nil
+}
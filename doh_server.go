@@ -0,0 +1,285 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/account-login/ctxlog"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const jsonMediaType = "application/dns-json"
+
+// RFC 8484 and the json api, on /dns-query
+type dohHandler struct {
+	server *Server
+}
+
+func (h *dohHandler) ServeHTTP(rw http.ResponseWriter, hreq *http.Request) {
+	st := h.server.state()
+	ctx := ctxlog.Pushf(hreq.Context(), "[session:%v]", atomic.AddUint64(&st.session, 1))
+	ctx = ctxlog.Pushf(ctx, "[doh-client:%v]", hreq.RemoteAddr)
+	if host, _, err := net.SplitHostPort(hreq.RemoteAddr); err == nil {
+		ctx = WithClientIP(ctx, net.ParseIP(host))
+	}
+
+	if hreq.URL.Path != "/dns-query" {
+		http.NotFound(rw, hreq)
+		return
+	}
+
+	st.inc()
+	defer st.dec()
+
+	// json api if asked for, or if name is given
+	query := hreq.URL.Query()
+	isJSON := hreq.Method == http.MethodGet &&
+		(query.Get("name") != "" || strings.Contains(hreq.Header.Get("Accept"), jsonMediaType))
+
+	var m *dm.Message
+	var err error
+	if isJSON {
+		m, err = parseJSONQuery(query)
+	} else {
+		m, err = parseWireQuery(hreq)
+	}
+	if err != nil {
+		ctxlog.Warnf(ctx, "bad req: %v", err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// log
+	ctx = ctxlog.Push(ctx, questionRepr(m))
+	ctxlog.Infof(ctx, "req: %v", ReprMessageShort(m))
+
+	res := h.server.resolve(ctx, m)
+
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(res)))
+	if isJSON {
+		data, _ := json.Marshal(makeJSONReply(res))
+		rw.Header().Set("Content-Type", jsonMediaType)
+		_, _ = rw.Write(data)
+		return
+	}
+
+	// same ID as req, mostly 0
+	buf, err := res.Pack()
+	if err != nil {
+		ctxlog.Errorf(ctx, "res.Pack(): %v", err)
+		http.Error(rw, "server error", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", dohMediaType)
+	_, _ = rw.Write(buf)
+}
+
+func parseWireQuery(hreq *http.Request) (*dm.Message, error) {
+	var data []byte
+	var err error
+	switch hreq.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(hreq.URL.Query().Get("dns"))
+		if err != nil {
+			return nil, fmt.Errorf("bad dns param: %v", err)
+		}
+	case http.MethodPost:
+		if ct := hreq.Header.Get("Content-Type"); ct != dohMediaType {
+			return nil, fmt.Errorf("bad content type: %q", ct)
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(hreq.Body, 64*1024))
+		if err != nil {
+			return nil, fmt.Errorf("read body: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("bad method: %v", hreq.Method)
+	}
+
+	m := &dm.Message{}
+	if err = m.Unpack(data); err != nil {
+		return nil, fmt.Errorf("unpack: %v", err)
+	}
+	return m, nil
+}
+
+func parseType(s string) (dm.Type, bool) {
+	if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return dm.Type(n), true
+	}
+	for t := dm.Type(1); t < 256; t++ {
+		if strings.EqualFold("Type"+s, t.String()) {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func parseJSONQuery(query map[string][]string) (*dm.Message, error) {
+	get := func(k string) string {
+		if v := query[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	name := get("name")
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dm.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("bad name: %v", err)
+	}
+
+	qtype := dm.TypeA
+	if s := get("type"); s != "" {
+		var ok bool
+		if qtype, ok = parseType(s); !ok {
+			return nil, fmt.Errorf("bad type: %q", s)
+		}
+	}
+
+	return &dm.Message{
+		Header: dm.Header{
+			RecursionDesired: true,
+			CheckingDisabled: get("cd") == "1" || get("cd") == "true",
+		},
+		Questions: []dm.Question{{Name: qname, Type: qtype, Class: dm.ClassINET}},
+	}, nil
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonReply struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRR       `json:"Answer,omitempty"`
+	Authority []jsonRR       `json:"Authority,omitempty"`
+}
+
+func rrData(rr *dm.Resource) string {
+	switch b := rr.Body.(type) {
+	case *dm.AResource:
+		return net.IP(b.A[:]).String()
+	case *dm.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dm.CNAMEResource:
+		return b.CNAME.String()
+	case *dm.NSResource:
+		return b.NS.String()
+	case *dm.PTRResource:
+		return b.PTR.String()
+	case *dm.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX.String())
+	case *dm.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target.String())
+	case *dm.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", b.NS.String(), b.MBox.String(),
+			b.Serial, b.Refresh, b.Retry, b.Expire, b.MinTTL)
+	case *dm.TXTResource:
+		quoted := make([]string, len(b.TXT))
+		for i, s := range b.TXT {
+			quoted[i] = strconv.Quote(s)
+		}
+		return strings.Join(quoted, " ")
+	case *dm.UnknownResource:
+		// RFC 3597
+		return fmt.Sprintf("\\# %d %s", len(b.Data), hex.EncodeToString(b.Data))
+	default:
+		return fmt.Sprintf("%v", rr.Body)
+	}
+}
+
+func makeJSONReply(res *dm.Message) *jsonReply {
+	reply := &jsonReply{
+		Status: int(res.RCode),
+		TC:     res.Truncated,
+		RD:     res.RecursionDesired,
+		RA:     res.RecursionAvailable,
+		AD:     res.AuthenticData,
+		CD:     res.CheckingDisabled,
+	}
+	for _, q := range res.Questions {
+		reply.Question = append(reply.Question, jsonQuestion{Name: q.Name.String(), Type: uint16(q.Type)})
+	}
+	toJSON := func(rrList []dm.Resource) (out []jsonRR) {
+		for i := range rrList {
+			rr := &rrList[i]
+			out = append(out, jsonRR{
+				Name: rr.Header.Name.String(),
+				Type: uint16(rr.Header.Type),
+				TTL:  rr.Header.TTL,
+				Data: rrData(rr),
+			})
+		}
+		return
+	}
+	reply.Answer = toJSON(res.Answers)
+	reply.Authority = toJSON(res.Authorities)
+	return reply
+}
+
+func minTTL(res *dm.Message) uint32 {
+	ttl := uint32(0)
+	for i, rr := range res.Answers {
+		if i == 0 || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+		}
+	}
+	return ttl
+}
+
+func (s *Server) listenDoH(ctx context.Context, certs *CertReloader) (*http.Server, error) {
+	listener, err := net.Listen("tcp", s.DoHListen)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{
+		Handler:   &dohHandler{server: s},
+		TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate},
+	}
+	st := s.state()
+	st.cond.L.Lock()
+	if st.quit {
+		st.cond.L.Unlock()
+		safeClose(ctx, listener)
+		return nil, ErrServerClosed
+	}
+	st.dohSrv = srv
+	st.cond.L.Unlock()
+
+	ctxlog.Infof(ctx, "doh server listening on %v", listener.Addr())
+	go func() {
+		err := srv.ServeTLS(listener, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			ctxlog.Errorf(ctx, "doh server: %v", err)
+		}
+	}()
+	return srv, nil
+}
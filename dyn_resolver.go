@@ -3,7 +3,6 @@ package dnsproxy
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/account-login/ctxlog"
@@ -38,6 +37,8 @@ type DynResolver struct {
 	name2ip6 map[string]net.IP
 	name2ttl map[string]uint32 // FIXME: v4 v6
 	config   dynConfig
+	// started by StartHTTP
+	servers []*http.Server
 }
 
 func (r *DynResolver) GetName() string {
@@ -339,6 +340,7 @@ func (r *DynResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message
 		Questions: req.Questions,
 		Answers:   rrList,
 	}
+	EchoEDNS(req, m, DefaultEDNSUDPSize)
 	return m, nil
 }
 
@@ -389,20 +391,42 @@ func (r *DynResolver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	response(rw, 0, "OK")
 }
 
-func (r *DynResolver) StartHTTP(ctx context.Context) error {
-	go func() {
-		if r.HTTPAddr == "" {
-			return
+func (r *DynResolver) addServer(server *http.Server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.servers = append(r.servers, server)
+}
+
+// Shutdown stops the http servers started by StartHTTP.
+func (r *DynResolver) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	servers := r.servers
+	r.servers = nil
+	r.mu.Unlock()
+
+	var firstErr error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
 		}
-		server := http.Server{
+	}
+	return firstErr
+}
+
+func (r *DynResolver) StartHTTP(ctx context.Context) error {
+	if r.HTTPAddr != "" {
+		server := &http.Server{
 			Addr:    r.HTTPAddr,
 			Handler: r,
 		}
-		err := server.ListenAndServe()
-		if err != nil {
-			ctxlog.Errorf(ctx, "DynResolver.StartHTTP: %v", err)
-		}
-	}()
+		r.addServer(server)
+		go func() {
+			err := server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				ctxlog.Errorf(ctx, "DynResolver.StartHTTP: %v", err)
+			}
+		}()
+	}
 
 	// https://youngkin.github.io/post/gohttpsclientserver/
 	doHTTPS := func() error {
@@ -412,21 +436,21 @@ func (r *DynResolver) StartHTTP(ctx context.Context) error {
 
 		tlsConf := &tls.Config{}
 		if r.TLSCertFile != "" {
-			caCert, err := ioutil.ReadFile(r.TLSClientCAFile)
+			caCertPool, err := loadCertPool(r.TLSClientCAFile)
 			if err != nil {
 				return errors.Wrap(err, "open client ca file")
 			}
-			caCertPool := x509.NewCertPool()
-			caCertPool.AppendCertsFromPEM(caCert)
 			tlsConf.ClientCAs = caCertPool
 			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
 		}
-		server := http.Server{
+		server := &http.Server{
 			Addr:      r.HTTPSAddr,
 			Handler:   r,
 			TLSConfig: tlsConf,
 		}
-		if err := server.ListenAndServeTLS(r.TLSCertFile, r.TLSKeyFile); err != nil {
+		r.addServer(server)
+		err := server.ListenAndServeTLS(r.TLSCertFile, r.TLSKeyFile)
+		if err != nil && err != http.ErrServerClosed {
 			return errors.Wrap(err, "ListenAndServeTLS")
 		}
 		return nil
@@ -0,0 +1,198 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/account-login/ctxlog"
+	"github.com/pkg/errors"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"net"
+)
+
+// EDNS Client Subnet, RFC 7871
+const optCodeECS = 8
+
+type ecsOption struct {
+	SourcePrefix uint8
+	ScopePrefix  uint8
+	// masked to SourcePrefix, 4 or 16 bytes
+	IP net.IP
+}
+
+func (o *ecsOption) pack() dm.Option {
+	family := uint16(1)
+	if len(o.IP) == net.IPv6len {
+		family = 2
+	}
+	addrLen := (int(o.SourcePrefix) + 7) / 8
+	data := make([]byte, 4+addrLen)
+	binary.BigEndian.PutUint16(data[0:2], family)
+	data[2] = o.SourcePrefix
+	data[3] = o.ScopePrefix
+	copy(data[4:], o.IP[:addrLen])
+	return dm.Option{Code: optCodeECS, Data: data}
+}
+
+func unpackECS(opt *dm.Option) (*ecsOption, error) {
+	data := opt.Data
+	if len(data) < 4 {
+		return nil, errors.New("ecs option too short")
+	}
+	o := &ecsOption{SourcePrefix: data[2], ScopePrefix: data[3]}
+	switch binary.BigEndian.Uint16(data[0:2]) {
+	case 1:
+		o.IP = make(net.IP, net.IPv4len)
+	case 2:
+		o.IP = make(net.IP, net.IPv6len)
+	default:
+		return nil, errors.New("unknown ecs family")
+	}
+	if int(o.SourcePrefix) > len(o.IP)*8 || len(data)-4 > len(o.IP) {
+		return nil, errors.New("bad ecs prefix")
+	}
+	copy(o.IP, data[4:])
+	return o, nil
+}
+
+func findECS(m *dm.Message) *ecsOption {
+	opt := findOPT(m)
+	if opt == nil {
+		return nil
+	}
+	for i := range opt.Body.(*dm.OPTResource).Options {
+		o := &opt.Body.(*dm.OPTResource).Options[i]
+		if o.Code == optCodeECS {
+			ecs, err := unpackECS(o)
+			if err != nil {
+				return nil
+			}
+			return ecs
+		}
+	}
+	return nil
+}
+
+// stripECS removes the ECS option from res without modifying the shared OPT body.
+func stripECS(res *dm.Message) {
+	opt := findOPT(res)
+	if opt == nil {
+		return
+	}
+	body := opt.Body.(*dm.OPTResource)
+	var options []dm.Option
+	for _, o := range body.Options {
+		if o.Code != optCodeECS {
+			options = append(options, o)
+		}
+	}
+	if len(options) != len(body.Options) {
+		opt.Body = &dm.OPTResource{Options: options}
+	}
+}
+
+type clientAddrKey struct{}
+
+// WithClientIP tells resolvers who is asking.
+func WithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, ip)
+}
+
+func ClientIPFromContext(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(clientAddrKey{}).(net.IP)
+	return ip
+}
+
+// AddrIP gets the ip of net.UDPAddr or net.TCPAddr.
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, _ := net.SplitHostPort(addr.String())
+		return net.ParseIP(host)
+	}
+}
+
+// the address the reply is for: the client supplied ECS, or the client ip
+func requestSubnetIP(ctx context.Context, req *dm.Message) net.IP {
+	if ecs := findECS(req); ecs != nil {
+		return ecs.IP
+	}
+	ip := ClientIPFromContext(ctx)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip
+}
+
+// ECSResolver adds ECS option to the queries of Child.
+type ECSResolver struct {
+	Child Resolver
+	Name  string
+	// use this subnet, or derive from client ip if nil
+	Subnet *net.IPNet
+	// for the client ip, default to 24 and 56
+	V4Prefix uint8
+	V6Prefix uint8
+}
+
+func (r *ECSResolver) GetName() string {
+	return r.Name
+}
+
+func (r *ECSResolver) option(ctx context.Context) *ecsOption {
+	if r.Subnet != nil {
+		ones, _ := r.Subnet.Mask.Size()
+		return &ecsOption{SourcePrefix: uint8(ones), IP: r.Subnet.IP}
+	}
+	return clientSubnet(ctx, r.V4Prefix, r.V6Prefix)
+}
+
+// the subnet of the client ip, nil for no client ip or a non public one
+func clientSubnet(ctx context.Context, v4Prefix uint8, v6Prefix uint8) *ecsOption {
+	ip := ClientIPFromContext(ctx)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return nil // no use for upstream
+	}
+	prefix := v6Prefix
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		prefix = v4Prefix
+	}
+	bits := len(ip) * 8
+	return &ecsOption{SourcePrefix: prefix, IP: ip.Mask(net.CIDRMask(int(prefix), bits))}
+}
+
+func (r *ECSResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message, error) {
+	if findECS(req) != nil {
+		return r.Child.Resolve(ctx, req) // client supplied
+	}
+	ecs := r.option(ctx)
+	if ecs == nil {
+		return r.Child.Resolve(ctx, req)
+	}
+	ctxlog.Debugf(ctx, "[ecs:%v/%v]", ecs.IP, ecs.SourcePrefix)
+
+	// add ECS to a copy of OPT
+	newReq := *req
+	newReq.Additionals = nil
+	found := false
+	for _, rr := range req.Additionals {
+		if rr.Header.Type == dm.TypeOPT {
+			found = true
+			body := rr.Body.(*dm.OPTResource)
+			options := append([]dm.Option(nil), body.Options...)
+			rr.Body = &dm.OPTResource{Options: append(options, ecs.pack())}
+		}
+		newReq.Additionals = append(newReq.Additionals, rr)
+	}
+	if !found {
+		opt := dm.Resource{Body: &dm.OPTResource{Options: []dm.Option{ecs.pack()}}}
+		_ = opt.Header.SetEDNS0(DefaultEDNSUDPSize, dm.RCodeSuccess, false)
+		newReq.Additionals = append(newReq.Additionals, opt)
+	}
+
+	return r.Child.Resolve(ctx, &newReq)
+}
@@ -0,0 +1,171 @@
+package dnsproxy
+
+import (
+	"github.com/pkg/errors"
+	dm "golang.org/x/net/dns/dnsmessage"
+)
+
+// the udp payload size we advertise, as recommended by DNS flag day 2020
+const DefaultEDNSUDPSize = 1232
+
+// RFC 6891 section 9
+const RCodeBadVers dm.RCode = 16
+
+func findOPT(m *dm.Message) *dm.Resource {
+	for i := range m.Additionals {
+		if m.Additionals[i].Header.Type == dm.TypeOPT {
+			return &m.Additionals[i]
+		}
+	}
+	return nil
+}
+
+func withoutOPT(rrList []dm.Resource) []dm.Resource {
+	var out []dm.Resource
+	for _, rr := range rrList {
+		if rr.Header.Type != dm.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// ClientUDPSize is the max udp reply size the client can receive.
+func ClientUDPSize(req *dm.Message) int {
+	opt := findOPT(req)
+	if opt == nil || opt.Header.Class < 512 {
+		return 512
+	}
+	return int(opt.Header.Class)
+}
+
+// ExtendedRCode combines the header RCode with the upper bits in OPT.
+func ExtendedRCode(m *dm.Message) dm.RCode {
+	if opt := findOPT(m); opt != nil {
+		return opt.Header.ExtendedRCode(m.RCode)
+	}
+	return m.RCode
+}
+
+// setRCode puts the lower 4 bits into header and the rest into OPT, OPT must exist for rcode > 15.
+func setRCode(m *dm.Message, rcode dm.RCode, opt *dm.Resource) {
+	m.RCode = rcode & 0xf
+	if opt != nil {
+		opt.Header.TTL = opt.Header.TTL&0x00ffffff | uint32(rcode>>4)<<24
+	}
+}
+
+// withUpstreamOPT returns additionals with OPT advertising udpSize, the DO bit and options are kept.
+func withUpstreamOPT(req *dm.Message, udpSize int) []dm.Resource {
+	out := make([]dm.Resource, 0, len(req.Additionals)+1)
+	found := false
+	for _, rr := range req.Additionals {
+		if rr.Header.Type == dm.TypeOPT {
+			found = true
+			rr.Header.Class = dm.Class(udpSize)
+			rr.Header.TTL &= 0x00ffffff // no extended rcode in query
+		}
+		out = append(out, rr)
+	}
+	if !found {
+		opt := dm.Resource{Body: &dm.OPTResource{}}
+		_ = opt.Header.SetEDNS0(udpSize, dm.RCodeSuccess, false)
+		out = append(out, opt)
+	}
+	return out
+}
+
+// EchoEDNS makes the OPT in res agree with req: present only if the client speaks EDNS,
+// advertising udpSize, with the DO bit of the client and the extended rcode of res.
+// ECS is removed unless the client asked with it.
+func EchoEDNS(req *dm.Message, res *dm.Message, udpSize int) {
+	reqOPT := findOPT(req)
+	resOPT := findOPT(res)
+
+	if reqOPT == nil {
+		if resOPT != nil {
+			rcode := ExtendedRCode(res)
+			res.Additionals = withoutOPT(res.Additionals)
+			if rcode > 0xf {
+				res.RCode = dm.RCodeServerFailure // can not be expressed without OPT
+			}
+		}
+		return
+	}
+
+	if resOPT == nil {
+		opt := dm.Resource{Body: &dm.OPTResource{}}
+		_ = opt.Header.SetEDNS0(udpSize, res.RCode, reqOPT.Header.DNSSECAllowed())
+		res.Additionals = append(res.Additionals, opt)
+		resOPT = &res.Additionals[len(res.Additionals)-1]
+		setRCode(res, res.RCode, resOPT)
+		return
+	}
+
+	// res may be shared with cache, modify a copy
+	rcode := resOPT.Header.ExtendedRCode(res.RCode)
+	res.Additionals = append([]dm.Resource(nil), res.Additionals...)
+	resOPT = findOPT(res)
+	resOPT.Header.Class = dm.Class(udpSize)
+	setRCode(res, rcode, resOPT)
+	if findECS(req) == nil {
+		stripECS(res)
+	}
+}
+
+// BadVersReply is the reply for unsupported EDNS version, or nil if the version is ok.
+func BadVersReply(req *dm.Message, udpSize int) *dm.Message {
+	opt := findOPT(req)
+	if opt == nil || (opt.Header.TTL>>16)&0xff == 0 {
+		return nil
+	}
+
+	res := &dm.Message{
+		Header: dm.Header{
+			ID: req.ID,
+			// flags
+			Response: true, RecursionDesired: req.RecursionDesired,
+		},
+		Questions: req.Questions,
+	}
+	resOPT := dm.Resource{Body: &dm.OPTResource{}}
+	_ = resOPT.Header.SetEDNS0(udpSize, RCodeBadVers, opt.Header.DNSSECAllowed())
+	res.Additionals = []dm.Resource{resOPT}
+	setRCode(res, RCodeBadVers, &res.Additionals[0])
+	return res
+}
+
+// PackUDP packs res within maxSize. RRs are dropped and TC is set if it does not fit.
+func PackUDP(res *dm.Message, maxSize int) ([]byte, error) {
+	buf, err := res.Pack()
+	if err != nil || len(buf) <= maxSize {
+		return buf, err
+	}
+
+	// keep the original message intact
+	trimmed := *res
+	// drop additionals except OPT, no need to set TC, RFC 2181 section 9
+	trimmed.Additionals = nil
+	if opt := findOPT(res); opt != nil {
+		trimmed.Additionals = []dm.Resource{*opt}
+	}
+	buf, err = trimmed.Pack()
+	if err != nil || len(buf) <= maxSize {
+		return buf, err
+	}
+
+	// then authorities and answers from the tail
+	trimmed.Truncated = true
+	trimmed.Authorities = nil
+	for n := len(res.Answers); n >= 0; n-- {
+		trimmed.Answers = res.Answers[:n]
+		buf, err = trimmed.Pack()
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) <= maxSize {
+			return buf, nil
+		}
+	}
+	return nil, errors.Errorf("can not fit message in %d bytes", maxSize)
+}
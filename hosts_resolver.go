@@ -86,5 +86,6 @@ func (r *HostsResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Messa
 		Questions: req.Questions,
 		Answers:   rrList,
 	}
+	EchoEDNS(req, m, DefaultEDNSUDPSize)
 	return m, nil
 }
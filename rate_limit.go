@@ -0,0 +1,264 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"fmt"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the default max number of buckets of each kind
+const defaultMaxBuckets = 100000
+
+// RateLimiter limits queries per client ip and per client prefix with token buckets,
+// and limits identical udp responses to the same prefix like the RRL of BIND.
+type RateLimiter struct {
+	// per client ip, 0 to disable. bursts below 1 are taken as 1
+	QPS   float64
+	Burst float64
+	// per client prefix, 0 to disable
+	PrefixQPS   float64
+	PrefixBurst float64
+	V4Prefix    int
+	V6Prefix    int
+	// identical responses per second to a client prefix, 0 to disable.
+	// it is also the burst
+	RRLRPS float64
+	// every RRLSlip-th limited response is sent as an empty TC=1 reply
+	// so real clients can retry with tcp, 0 to drop all
+	RRLSlip int
+	// clients not limited
+	Exempt []*net.IPNet
+	// max buckets of each kind, the least recently used bucket is evicted when full.
+	// 0 means defaultMaxBuckets
+	MaxBuckets int
+	// private
+	mu        sync.Mutex
+	clients   bucketMap
+	prefixes  bucketMap
+	responses bucketMap
+	slipped   int
+}
+
+type tokenBucket struct {
+	key     string
+	elem    *list.Element
+	tokens  float64
+	lastNs  int64
+	dropped uint64
+}
+
+// buckets in lru order, the idle ones are at the back
+type bucketMap struct {
+	buckets map[string]*tokenBucket
+	lru     list.List
+}
+
+func (b *tokenBucket) refill(rate float64, burst float64, nowNs int64) {
+	b.tokens += rate * float64(nowNs-b.lastNs) / 1e9
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.lastNs = nowNs
+}
+
+// take a token from the bucket of key, false if empty.
+// name is for stats.
+func (m *bucketMap) take(name string, key string, rate float64, burst float64, maxBuckets int, nowNs int64) bool {
+	if burst < 1 {
+		burst = 1 // or it never holds a token
+	}
+	if m.buckets == nil {
+		m.buckets = map[string]*tokenBucket{}
+	}
+	m.trim(rate, burst, nowNs)
+
+	b := m.buckets[key]
+	if b == nil {
+		for len(m.buckets) >= maxBuckets && m.lru.Len() > 0 {
+			m.remove(m.lru.Back().Value.(*tokenBucket))
+			statAdd("ratelimit."+name+".evicted", 1)
+		}
+		b = &tokenBucket{key: key, tokens: burst, lastNs: nowNs}
+		b.elem = m.lru.PushFront(b)
+		m.buckets[key] = b
+	} else {
+		m.lru.MoveToFront(b.elem)
+	}
+	statSet("ratelimit."+name+".buckets", int64(len(m.buckets)))
+
+	b.refill(rate, burst, nowNs)
+	if b.tokens < 1 {
+		b.dropped++
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+func (m *bucketMap) remove(b *tokenBucket) {
+	m.lru.Remove(b.elem)
+	delete(m.buckets, b.key)
+}
+
+// remove the full buckets from the back, which behave the same as new ones.
+// every bucket is removed at most once, so it is O(1) per take on average.
+func (m *bucketMap) trim(rate float64, burst float64, nowNs int64) {
+	for m.lru.Len() > 0 {
+		b := m.lru.Back().Value.(*tokenBucket)
+		b.refill(rate, burst, nowNs)
+		if b.tokens < burst {
+			break
+		}
+		m.remove(b)
+	}
+}
+
+func (r *RateLimiter) maxBuckets() int {
+	if r.MaxBuckets > 0 {
+		return r.MaxBuckets
+	}
+	return defaultMaxBuckets
+}
+
+// the ip as a key
+func ipKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.String()
+}
+
+// the prefix of ip as a key, like "1.2.3.0/24"
+func (r *RateLimiter) prefixKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%v/%d", ip4.Mask(net.CIDRMask(r.V4Prefix, 32)), r.V4Prefix)
+	}
+	return fmt.Sprintf("%v/%d", ip.Mask(net.CIDRMask(r.V6Prefix, 128)), r.V6Prefix)
+}
+
+func (r *RateLimiter) exempt(ip net.IP) bool {
+	for _, n := range r.Exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowQuery takes a token for a query from ip, false if limited.
+func (r *RateLimiter) AllowQuery(ip net.IP) bool {
+	if ip == nil || r.exempt(ip) {
+		return true
+	}
+	nowNs := time.Now().UnixNano()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.QPS > 0 && !r.clients.take("clients", ipKey(ip), r.QPS, r.Burst, r.maxBuckets(), nowNs) {
+		return false
+	}
+	if r.PrefixQPS > 0 && !r.prefixes.take("prefixes", r.prefixKey(ip), r.PrefixQPS, r.PrefixBurst, r.maxBuckets(), nowNs) {
+		return false
+	}
+	return true
+}
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlSlip
+	rrlDrop
+)
+
+// the response to ip, identical responses share the same key
+func (r *RateLimiter) responseKey(ip net.IP, res *dm.Message) string {
+	key := r.prefixKey(ip) + "|" + res.RCode.String()
+	if len(res.Questions) > 0 {
+		q := &res.Questions[0]
+		key += "|" + q.Type.String() + "|" + strings.ToLower(q.Name.String())
+	}
+	return key
+}
+
+// limit the udp response to ip
+func (r *RateLimiter) response(ip net.IP, res *dm.Message) rrlAction {
+	if r.RRLRPS <= 0 || ip == nil || r.exempt(ip) {
+		return rrlSend
+	}
+	nowNs := time.Now().UnixNano()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.responses.take("responses", r.responseKey(ip, res), r.RRLRPS, r.RRLRPS, r.maxBuckets(), nowNs) {
+		return rrlSend
+	}
+	if r.RRLSlip > 0 {
+		r.slipped++
+		if r.slipped%r.RRLSlip == 0 {
+			return rrlSlip
+		}
+	}
+	return rrlDrop
+}
+
+// an empty reply with TC=1, the client should retry with tcp
+func slipReply(req *dm.Message) *dm.Message {
+	res := errReply(req)
+	res.RCode = dm.RCodeSuccess
+	res.Truncated = true
+	return res
+}
+
+type limitedInfo struct {
+	Key     string  `json:"key"`
+	Tokens  float64 `json:"tokens"`
+	Dropped uint64  `json:"dropped"`
+}
+
+// the buckets that dropped queries, most dropped first
+func (m *bucketMap) limited(max int) []limitedInfo {
+	out := []limitedInfo{}
+	for key, b := range m.buckets {
+		if b.dropped > 0 {
+			out = append(out, limitedInfo{Key: key, Tokens: b.tokens, Dropped: b.dropped})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Dropped > out[j].Dropped
+	})
+	if len(out) > max {
+		out = out[:max]
+	}
+	return out
+}
+
+// RateLimitHandler lists the recently limited clients on /debug/ratelimit
+type RateLimitHandler struct {
+	Server *Server
+}
+
+func (h *RateLimitHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r := h.Server.currentTree().limiter
+	if r == nil {
+		adminError(rw, http.StatusNotFound, "rate limit not enabled")
+		return
+	}
+
+	r.mu.Lock()
+	out := map[string][]limitedInfo{
+		"clients":   r.clients.limited(100),
+		"prefixes":  r.prefixes.limited(100),
+		"responses": r.responses.limited(100),
+	}
+	r.mu.Unlock()
+	adminReply(rw, http.StatusOK, out)
+}
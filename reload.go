@@ -0,0 +1,127 @@
+package dnsproxy
+
+import (
+	"context"
+	"github.com/account-login/ctxlog"
+	"strings"
+	"time"
+)
+
+// the part of Server replaced by Reload
+type resolverTree struct {
+	root    Resolver
+	timeout time.Duration
+	caches  []*CacheResolver
+	dyns    []*DynResolver
+	tcps    []*TCPResolver
+	acl     []*ACLGroup
+	limiter *RateLimiter
+}
+
+func (s *Server) currentTree() *resolverTree {
+	if tree, ok := s.tree.Load().(*resolverTree); ok {
+		return tree
+	}
+	return &resolverTree{
+		root: s.RootResolver, timeout: s.Timeout, caches: s.Caches, dyns: s.dyns, tcps: s.tcps,
+		acl: s.ACL, limiter: s.RateLimit,
+	}
+}
+
+// Root is the current root resolver, which may be changed by Reload.
+func (s *Server) Root() Resolver {
+	return s.currentTree().root
+}
+
+// CurrentTimeout is the timeout of the current config.
+func (s *Server) CurrentTimeout() time.Duration {
+	return s.currentTree().timeout
+}
+
+// CurrentCaches are the caches of the current resolver tree.
+func (s *Server) CurrentCaches() []*CacheResolver {
+	return s.currentTree().caches
+}
+
+func sameDynConfig(a *DynResolver, b *DynResolver) bool {
+	return a.Name == b.Name && a.DBPath == b.DBPath &&
+		strings.Join(a.Suffixies, ",") == strings.Join(b.Suffixies, ",") &&
+		a.HTTPAddr == b.HTTPAddr && a.HTTPSAddr == b.HTTPSAddr &&
+		a.TLSCertFile == b.TLSCertFile && a.TLSKeyFile == b.TLSKeyFile &&
+		a.TLSClientCAFile == b.TLSClientCAFile
+}
+
+// Reload builds a new resolver tree from config and swaps it in.
+// queries in flight finish on the old tree.
+// caches with the same name and type are carried over.
+// listeners and upstream sockets are not changed.
+func (s *Server) Reload(ctx context.Context, input []byte) error {
+	ctx = ctxlog.Push(ctx, "[reload]")
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	newServer, err := makeServer(input, s)
+	if err != nil {
+		return err
+	}
+	if !sameListen(newServer.Listen, s.Listen) || newServer.DoHListen != s.DoHListen || newServer.DoTListen != s.DoTListen ||
+		newServer.UDPResolver.PoolSize != s.UDPResolver.PoolSize || newServer.EDNSUDPSize != s.EDNSUDPSize ||
+		newServer.UDPResolver.MaxSocketQueries != s.UDPResolver.MaxSocketQueries ||
+		newServer.UDPResolver.MaxSocketAge != s.UDPResolver.MaxSocketAge {
+		ctxlog.Warnf(ctx, "listeners and upstream sockets are not changed until restart")
+	}
+
+	// carry over caches
+	old := s.currentTree()
+	for _, c := range newServer.Caches {
+		for _, prev := range old.caches {
+			if prev.Name == c.Name && prev.kind == c.kind {
+				n := c.restore(prev.dump())
+				ctxlog.Infof(ctx, "[cache:%s] carried over %d entries", c.Name, n)
+			}
+		}
+	}
+
+	s.tree.Store(&resolverTree{
+		root:    newServer.RootResolver,
+		timeout: newServer.Timeout,
+		caches:  newServer.Caches,
+		dyns:    newServer.dyns,
+		tcps:    newServer.tcps,
+		acl:     newServer.ACL,
+		limiter: newServer.RateLimit,
+	})
+	ctxlog.Infof(ctx, "resolver tree replaced")
+
+	// replace the dyn resolvers not reused
+	for _, prev := range old.dyns {
+		if !containsDyn(newServer.dyns, prev) {
+			if err := prev.Shutdown(ctx); err != nil {
+				ctxlog.Errorf(ctx, "[dyn:%s] shutdown: %v", prev.Name, err)
+			}
+		}
+	}
+	startDyns(ctx, newServer.dyns, old.dyns)
+
+	// tcp upstreams are never reused, close them after queries on the old tree are done
+	delay := old.timeout
+	if delay < staleRefreshTimeout {
+		delay = staleRefreshTimeout
+	}
+	time.AfterFunc(delay, func() {
+		for _, r := range old.tcps {
+			safeClose(ctx, r)
+		}
+		ctxlog.Debugf(ctx, "closed %d tcp upstreams of the old tree", len(old.tcps))
+	})
+	return nil
+}
+
+// ShutdownHTTP stops the http servers of DynResolvers.
+func (s *Server) ShutdownHTTP(ctx context.Context) {
+	for _, r := range s.currentTree().dyns {
+		if err := r.Shutdown(ctx); err != nil {
+			ctxlog.Errorf(ctx, "[dyn:%s] shutdown: %v", r.Name, err)
+		}
+	}
+}
@@ -34,7 +34,7 @@ func ReprMessageShort(m *dm.Message) (repr string) {
 		return "(nil)"
 	}
 
-	repr += fmt.Sprintf("[ID:%v][OP:%v][RCode:%d]", m.ID, m.OpCode, m.RCode)
+	repr += fmt.Sprintf("[ID:%v][OP:%v][RCode:%d]", m.ID, m.OpCode, ExtendedRCode(m))
 	repr += "[flags:"
 	if m.Response {
 		repr += "+R"
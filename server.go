@@ -0,0 +1,741 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/account-login/ctxlog"
+	"github.com/account-login/dnsproxy/dns"
+	"github.com/pkg/errors"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("dnsproxy: Server closed")
+
+// the state of serving loops
+type serverState struct {
+	// for doh logging, plain listeners have their own counters
+	session uint64
+	// udp conns, tcp and dot listeners, doh server
+	conns     []net.PacketConn
+	listeners []net.Listener
+	dohSrv    *http.Server
+
+	// for gracefull shutdown
+	quit       bool
+	cond       sync.Cond
+	concurency int
+	// tcp and dot clients, woken up on shutdown or when the ctx of Serve is done
+	clients map[net.Conn]context.Context
+
+	// upstream sockets
+	udpOnce    sync.Once
+	udpErr     error
+	udpStarted bool
+}
+
+func (s *Server) state() *serverState {
+	s.stateOnce.Do(func() {
+		s.serving.cond.L = &sync.Mutex{}
+		s.serving.clients = map[net.Conn]context.Context{}
+	})
+	return &s.serving
+}
+
+func (st *serverState) inc() {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	st.concurency += 1
+}
+
+func (st *serverState) dec() {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	st.concurency -= 1
+	if st.concurency < 0 {
+		panic("st.concurency < 0")
+	}
+	if st.concurency == 0 {
+		st.cond.Broadcast()
+	}
+}
+
+func (st *serverState) exiting() bool {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	return st.quit
+}
+
+// track conns and listeners, false if shutting down
+func (st *serverState) track(conns []net.PacketConn, listeners []net.Listener) bool {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	if st.quit {
+		return false
+	}
+	st.conns = append(st.conns, conns...)
+	st.listeners = append(st.listeners, listeners...)
+	return true
+}
+
+// ctx is the serving ctx of the client
+func (st *serverState) addClient(ctx context.Context, conn net.Conn) {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	st.clients[conn] = ctx
+	if st.quit || ctx.Err() != nil {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (st *serverState) removeClient(conn net.Conn) {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	delete(st.clients, conn)
+}
+
+// stop reading new queries, in-flight queries can still be replied
+func (st *serverState) close(ctx context.Context) {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	st.quit = true
+	for conn := range st.clients {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	for _, listener := range st.listeners {
+		safeClose(ctx, listener)
+	}
+	for _, conn := range st.conns {
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			ctxlog.Errorf(ctx, "SetReadDeadline: %v", err)
+		}
+	}
+}
+
+// wake up the clients whose serving ctx is done
+func (st *serverState) wakeClients() {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	for conn, ctx := range st.clients {
+		if ctx.Err() != nil {
+			_ = conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// wait until all done or ctx expired, returns false on timeout
+func (st *serverState) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		st.cond.L.Lock()
+		defer st.cond.L.Unlock()
+		for st.concurency != 0 {
+			st.cond.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (st *serverState) pending() int {
+	st.cond.L.Lock()
+	defer st.cond.L.Unlock()
+	return st.concurency
+}
+
+func questionRepr(m *dm.Message) string {
+	if len(m.Questions) > 0 {
+		return ReprQuestionShort(&m.Questions[0])
+	} else {
+		return "[NOT-QUESTION]"
+	}
+}
+
+func errReply(req *dm.Message) *dm.Message {
+	res := &dm.Message{
+		Header: dm.Header{
+			ID:    req.ID,
+			RCode: dm.RCodeNameError,
+			// flags
+			Authoritative: false, Response: true, RecursionDesired: true,
+		},
+		Questions: req.Questions,
+	}
+	EchoEDNS(req, res, DefaultEDNSUDPSize)
+	return res
+}
+
+// resolve the req, the reply is never nil
+func (s *Server) resolve(ctx context.Context, m *dm.Message) *dm.Message {
+	tree := s.currentTree()
+	root := tree.root
+
+	// access control by client ip
+	group, ok := matchACL(tree.acl, ClientIPFromContext(ctx))
+	if group != nil {
+		ctx = ctxlog.Pushf(ctx, "[acl:%s]", group.Name)
+		if group.Root != nil {
+			root = group.Root
+		}
+	}
+	if !ok {
+		if group != nil {
+			statAdd("acl."+group.Name+".refused", 1)
+		} else {
+			statAdd("acl.default.refused", 1)
+		}
+		res := refusedReply(m)
+		ctxlog.Infof(ctx, "refused by acl. res: %v", ReprMessageShort(res))
+		return res
+	}
+
+	if res := BadVersReply(m, s.EDNSUDPSize); res != nil {
+		ctxlog.Infof(ctx, "res: %v", ReprMessageShort(res))
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tree.timeout)
+	defer cancel()
+
+	// resolve
+	res, err := root.Resolve(ctx, m)
+	if err != nil {
+		ctxlog.Errorf(ctx, "%v.Resolve: %v", root.GetName(), err)
+	}
+
+	// log
+	ctxlog.Infof(ctx, "res: %v", ReprMessageShort(res))
+
+	// generate error reply
+	if res == nil {
+		res = errReply(m)
+	}
+
+	EchoEDNS(m, res, s.EDNSUDPSize)
+	return res
+}
+
+// take a token for the query, false if the client is rate limited
+func (s *Server) allowQuery(ctx context.Context) bool {
+	rl := s.currentTree().limiter
+	if rl == nil || rl.AllowQuery(ClientIPFromContext(ctx)) {
+		return true
+	}
+	ctxlog.Debugf(ctx, "rate limited")
+	return false
+}
+
+// start the upstream sockets once
+func (s *Server) startUpstream() error {
+	st := s.state()
+	st.udpOnce.Do(func() {
+		st.udpErr = s.UDPResolver.Start()
+		st.udpStarted = st.udpErr == nil
+	})
+	return st.udpErr
+}
+
+// ListenAddr is an address to serve plain dns on.
+type ListenAddr struct {
+	// "udp", "tcp", or "" for both
+	Network string
+	Addr    string
+}
+
+// ParseListenAddr parses "udp://host:port", "tcp://host:port" or "host:port" for both.
+func ParseListenAddr(input string) (ListenAddr, error) {
+	la := ListenAddr{Addr: input}
+	if idx := strings.Index(input, "://"); idx >= 0 {
+		la.Network, la.Addr = input[:idx], input[idx+3:]
+		if la.Network != "udp" && la.Network != "tcp" {
+			return la, errors.Errorf("bad listen network: %q", input)
+		}
+	}
+	if _, _, err := net.SplitHostPort(la.Addr); err != nil {
+		return la, errors.Wrapf(err, "bad listen addr: %q", input)
+	}
+	return la, nil
+}
+
+func (la ListenAddr) String() string {
+	if la.Network == "" {
+		return la.Addr
+	}
+	return la.Network + "://" + la.Addr
+}
+
+func sameListen(a []ListenAddr, b []ListenAddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// a tcp or dot listener, name is for logs and stats, like "tcp://127.0.0.1:53"
+type namedListener struct {
+	net.Listener
+	name string
+}
+
+// ListenAndServe listens on every address of Listen, and on DoTListen and DoHListen if set.
+// it blocks until Shutdown or ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	var conns []net.PacketConn
+	var listeners []namedListener
+	closeAll := func() {
+		for _, conn := range conns {
+			safeClose(ctx, conn)
+		}
+		for _, listener := range listeners {
+			safeClose(ctx, listener)
+		}
+	}
+
+	for _, la := range s.Listen {
+		if la.Network != "tcp" {
+			conn, err := net.ListenPacket("udp", la.Addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			ctxlog.Infof(ctx, "udp server listening on %v", conn.LocalAddr())
+			conns = append(conns, conn)
+		}
+		if la.Network != "udp" {
+			listener, err := net.Listen("tcp", la.Addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			ctxlog.Infof(ctx, "tcp server listening on %v", listener.Addr())
+			listeners = append(listeners, namedListener{listener, "tcp://" + listener.Addr().String()})
+		}
+	}
+
+	var dohSrv *http.Server
+	if s.DoTListen != "" || s.DoHListen != "" {
+		certs := &CertReloader{CertFile: s.TLSCertFile, KeyFile: s.TLSKeyFile}
+		if err := certs.Load(); err != nil {
+			closeAll()
+			return err
+		}
+		if s.DoTListen != "" {
+			// same framing as tcp, RFC 7858
+			listener, err := tls.Listen("tcp", s.DoTListen, &tls.Config{GetCertificate: certs.GetCertificate})
+			if err != nil {
+				closeAll()
+				return err
+			}
+			ctxlog.Infof(ctx, "dot server listening on %v", listener.Addr())
+			listeners = append(listeners, namedListener{listener, "dot://" + listener.Addr().String()})
+		}
+		if s.DoHListen != "" {
+			var err error
+			if dohSrv, err = s.listenDoH(ctx, certs); err != nil {
+				closeAll()
+				return err
+			}
+		}
+	}
+
+	err := s.serve(ctx, conns, listeners)
+	if dohSrv != nil && ctx.Err() != nil {
+		safeClose(ctx, dohSrv)
+	}
+	return err
+}
+
+// Serve answers queries from conn and listener, either can be nil.
+// ctx is the parent of query contexts. it blocks until Shutdown or ctx is done,
+// or both conn and listener are closed by the caller.
+// it returns ctx.Err() if ctx is done, ErrServerClosed otherwise.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn, listener net.Listener) error {
+	var conns []net.PacketConn
+	var listeners []namedListener
+	if conn != nil {
+		conns = append(conns, conn)
+	}
+	if listener != nil {
+		listeners = append(listeners, namedListener{listener, "tcp://" + listener.Addr().String()})
+	}
+	return s.serve(ctx, conns, listeners)
+}
+
+func (s *Server) serve(ctx context.Context, conns []net.PacketConn, listeners []namedListener) error {
+	st := s.state()
+	closeAll := func() {
+		for _, conn := range conns {
+			safeClose(ctx, conn)
+		}
+		for _, listener := range listeners {
+			safeClose(ctx, listener)
+		}
+	}
+	if err := s.startUpstream(); err != nil {
+		closeAll()
+		return err
+	}
+	plain := make([]net.Listener, 0, len(listeners))
+	for _, listener := range listeners {
+		plain = append(plain, listener.Listener)
+	}
+	if !st.track(conns, plain) {
+		closeAll()
+		return ErrServerClosed
+	}
+
+	// the loops quit when the sockets are closed
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if !st.exiting() {
+				ctxlog.Infof(ctx, "serve: %v", ctx.Err())
+				closeAll()
+				st.wakeClients()
+			}
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		st.inc()
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			s.serveUDP(ctx, conn)
+		}(conn)
+	}
+	for _, listener := range listeners {
+		wg.Add(1)
+		st.inc()
+		go func(listener namedListener) {
+			defer wg.Done()
+			s.serveTCP(ctx, listener.name, listener.Listener)
+		}(listener)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrServerClosed
+}
+
+// stop the loop on err, false for transient errors
+func (st *serverState) stopOn(ctx context.Context, err error) bool {
+	return st.exiting() || errors.Is(err, net.ErrClosed) || ctx.Err() != nil
+}
+
+// Shutdown stops accepting queries and waits for in-flight queries until ctx expired.
+// the listeners and upstream sockets are closed at last.
+func (s *Server) Shutdown(ctx context.Context) error {
+	st := s.state()
+	st.close(ctx)
+
+	st.cond.L.Lock()
+	dohSrv := st.dohSrv
+	st.cond.L.Unlock()
+	if dohSrv != nil {
+		if err := dohSrv.Shutdown(ctx); err != nil {
+			ctxlog.Warnf(ctx, "doh shutdown: %v", err)
+			safeClose(ctx, dohSrv)
+		}
+	}
+	s.ShutdownHTTP(ctx)
+
+	var err error
+	if !st.wait(ctx) {
+		err = errors.Wrapf(ctx.Err(), "abandon %v in-flight queries", st.pending())
+	}
+
+	st.cond.L.Lock()
+	conns := st.conns
+	st.cond.L.Unlock()
+	for _, conn := range conns {
+		safeClose(ctx, conn)
+	}
+	// never start after shutdown
+	st.udpOnce.Do(func() {})
+	if st.udpStarted {
+		s.UDPResolver.Stop()
+		s.UDPResolver.Wait()
+	}
+	return err
+}
+
+func (s *Server) serveUDP(ctx context.Context, conn net.PacketConn) {
+	st := s.state()
+	defer st.dec()
+
+	// per listener session counter
+	name := "udp://" + conn.LocalAddr().String()
+	ctx = ctxlog.Pushf(ctx, "[listen:%s]", name)
+	session := uint64(0)
+
+	udpConn, isUDP := conn.(*net.UDPConn)
+	if isUDP {
+		if err := dns.SetSessionUDPOptions(udpConn); err != nil {
+			ctxlog.Errorf(ctx, "dns.SetSessionUDPOptions: %v", err)
+			// ignore err
+		}
+	}
+
+	// loop for udp client
+	buf := make([]byte, 64*1024)
+	for {
+		session++
+		ctx := ctxlog.Pushf(ctx, "[session:%v]", session)
+
+		// read from client
+		var n int
+		var sess *dns.SessionUDP
+		var addr net.Addr
+		var err error
+		if isUDP {
+			n, sess, err = dns.ReadFromSessionUDP(udpConn, buf)
+			if sess != nil {
+				addr = sess.RemoteAddr()
+			}
+		} else {
+			n, addr, err = conn.ReadFrom(buf)
+		}
+		if err == io.EOF {
+			ctxlog.Infof(ctx, "server eof")
+			break
+		}
+		if err != nil {
+			if st.stopOn(ctx, err) {
+				break
+			}
+			ctxlog.Errorf(ctx, "conn.ReadFrom(): %v", err)
+			continue
+		}
+		statAdd("listen."+name+".sessions", 1)
+		ctx = ctxlog.Pushf(ctx, "[client:%v]", addr)
+		ctx = WithClientIP(ctx, AddrIP(addr))
+
+		// drop silently, replies would feed the flood
+		if !s.allowQuery(ctx) {
+			statAdd("ratelimit.dropped", 1)
+			continue
+		}
+
+		// parse req
+		m := &dm.Message{}
+		err = m.Unpack(buf[:n])
+		if err != nil {
+			ctxlog.Warnf(ctx, "unpack: %v", err)
+			continue
+		}
+
+		// log
+		ctx = ctxlog.Push(ctx, questionRepr(m))
+		ctxlog.Infof(ctx, "req: %v", ReprMessageShort(m))
+		statAdd("listen."+name+".queries", 1)
+
+		// resolve and reply
+		st.inc()
+		go func(sess *dns.SessionUDP, addr net.Addr) {
+			defer st.dec()
+
+			res := s.resolve(ctx, m)
+
+			// response rate limiting
+			if rl := s.currentTree().limiter; rl != nil {
+				switch rl.response(ClientIPFromContext(ctx), res) {
+				case rrlSlip:
+					statAdd("ratelimit.rrl_slipped", 1)
+					ctxlog.Debugf(ctx, "rrl slipped")
+					res = slipReply(m)
+				case rrlDrop:
+					statAdd("ratelimit.rrl_dropped", 1)
+					ctxlog.Debugf(ctx, "rrl dropped")
+					return
+				}
+			}
+
+			// pack result, truncated if too large for client
+			buf, err := PackUDP(res, ClientUDPSize(m))
+			if err != nil {
+				ctxlog.Errorf(ctx, "res.Pack(): %v", err)
+				return
+			}
+
+			// reply client
+			if isUDP {
+				_, err = dns.WriteToSessionUDP(udpConn, buf, sess)
+			} else {
+				_, err = conn.WriteTo(buf, addr)
+			}
+			if err != nil {
+				ctxlog.Errorf(ctx, "conn.WriteTo(): %v", err)
+				return
+			}
+		}(sess, addr)
+	} // loop for req
+}
+
+const defaultTCPIdleTimeout = 10 * time.Second
+
+func (s *Server) tcpIdleTimeout() time.Duration {
+	if s.TCPIdleTimeout > 0 {
+		return s.TCPIdleTimeout
+	}
+	return defaultTCPIdleTimeout
+}
+
+// name is the listener in logs and stats, like "tcp://127.0.0.1:53"
+func (s *Server) serveTCP(ctx context.Context, name string, listener net.Listener) {
+	st := s.state()
+	defer st.dec()
+
+	// per listener session counter
+	ctx = ctxlog.Pushf(ctx, "[listen:%s]", name)
+	session := uint64(0)
+	for {
+		session++
+		ctx := ctxlog.Pushf(ctx, "[session:%v]", session)
+
+		// accept
+		conn, err := listener.Accept()
+		if err != nil {
+			if st.stopOn(ctx, err) {
+				break
+			}
+			ctxlog.Errorf(ctx, "accept: %v", err)
+			continue
+		}
+		statAdd("listen."+name+".sessions", 1)
+
+		st.inc()
+		go func(conn net.Conn) {
+			defer st.dec()
+			defer safeClose(ctx, conn)
+			st.addClient(ctx, conn)
+			defer st.removeClient(conn)
+
+			ctx := ctxlog.Pushf(ctx, "[client:%v]", conn.RemoteAddr())
+			ctx = WithClientIP(ctx, AddrIP(conn.RemoteAddr()))
+
+			// idle clients are closed. the deadline may overwrite the one set by shutdown,
+			// so check it again after.
+			idle := s.tcpIdleTimeout()
+			setIdle := func() bool {
+				_ = conn.SetReadDeadline(time.Now().Add(idle))
+				return !st.exiting() && ctx.Err() == nil
+			}
+
+			// dot handshake, slow clients must not hold the conn
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if !setIdle() {
+					return
+				}
+				_ = conn.SetWriteDeadline(time.Now().Add(idle))
+				if err := tlsConn.Handshake(); err != nil {
+					ctxlog.Infof(ctx, "tls handshake: %v", err)
+					return
+				}
+				_ = conn.SetWriteDeadline(time.Time{})
+			}
+
+			// TODO: try sync.Pool?
+			rbuf := bufio.NewReaderSize(conn, 64*1024)
+			buf := make([]byte, 64*1024)
+			for {
+				if !setIdle() {
+					break
+				}
+
+				// read len field
+				_, err := io.ReadFull(rbuf, buf[:2])
+				if err == io.EOF {
+					ctxlog.Infof(ctx, "client leave")
+					break
+				}
+				if err != nil {
+					if !st.exiting() && ctx.Err() == nil {
+						if errors.Is(err, os.ErrDeadlineExceeded) {
+							ctxlog.Infof(ctx, "client idle")
+						} else {
+							ctxlog.Errorf(ctx, "read len: %v", err)
+						}
+					}
+					break
+				}
+				if ctx.Err() != nil {
+					break // Serve is done
+				}
+
+				// read body
+				length := binary.BigEndian.Uint16(buf[:2])
+				_, err = io.ReadFull(rbuf, buf[:length])
+				if err != nil {
+					ctxlog.Errorf(ctx, "read body: %v", err)
+					break
+				}
+
+				// parse req
+				m := &dm.Message{}
+				err = m.Unpack(buf[:length])
+				if err != nil {
+					ctxlog.Warnf(ctx, "unpack: %v", err)
+					break
+				}
+
+				// log
+				ctx = ctxlog.Push(ctx, questionRepr(m))
+				ctxlog.Infof(ctx, "req: %v", ReprMessageShort(m))
+				statAdd("listen."+name+".queries", 1)
+
+				func() {
+					var res *dm.Message
+					if s.allowQuery(ctx) {
+						res = s.resolve(ctx, m)
+					} else {
+						statAdd("ratelimit.refused", 1)
+						res = refusedReply(m)
+					}
+
+					// pack result
+					rpack := buf[:2]
+					rpack, err := res.AppendPack(rpack)
+					if err != nil {
+						ctxlog.Errorf(ctx, "res.Pack(): %v", err)
+						return
+					}
+
+					// reply length field
+					binary.BigEndian.PutUint16(rpack[:2], uint16(len(rpack)-2))
+
+					// reply client
+					_, err = conn.Write(rpack)
+					if err != nil {
+						ctxlog.Errorf(ctx, "conn.Write(): %v", err)
+						return
+					}
+				}()
+			} // loop parse req
+		}(conn)
+	} // loop accept conn
+}
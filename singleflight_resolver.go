@@ -0,0 +1,129 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/account-login/ctxlog"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"sync"
+	"time"
+)
+
+// SingleflightResolver merges identical in-flight queries into one query to Child.
+type SingleflightResolver struct {
+	Child Resolver
+	Name  string
+	// the client subnet prefixes of the "ecs": "client" leaves below, 0 if none.
+	// queries from different subnets are not merged.
+	ClientV4Prefix uint8
+	ClientV6Prefix uint8
+	// private
+	flight flightGroup
+}
+
+func (r *SingleflightResolver) GetName() string {
+	return r.Name
+}
+
+func (r *SingleflightResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message, error) {
+	if !reqShouldCache(req) {
+		return r.Child.Resolve(ctx, req)
+	}
+	key := flightKey(ctx, req, r.ClientV4Prefix, r.ClientV6Prefix)
+	return r.flight.do(ctx, r.Name, key, req, func(ctx context.Context) (*dm.Message, error) {
+		return r.Child.Resolve(ctx, req)
+	})
+}
+
+type flightCall struct {
+	done chan struct{}
+	res  *dm.Message
+	// packed res, unpacked for each caller so that nothing is shared
+	data []byte
+	err  error
+}
+
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// the shared query is abandoned after this if the first caller has no deadline
+const flightTimeout = 10 * time.Second
+
+// the key of identical queries, the client supplied ECS is included.
+// without it, the client subnet by v4Prefix and v6Prefix is included if they are not 0,
+// for the leaves with "ecs": "client".
+func flightKey(ctx context.Context, req *dm.Message, v4Prefix uint8, v6Prefix uint8) string {
+	key := cacheKey(req)
+	if ecs := findECS(req); ecs != nil {
+		key = fmt.Sprintf("%s@%v/%d", key, ecs.IP, ecs.SourcePrefix)
+	} else if v4Prefix > 0 || v6Prefix > 0 {
+		if ecs := clientSubnet(ctx, v4Prefix, v6Prefix); ecs != nil {
+			key = fmt.Sprintf("%s@%v/%d", key, ecs.IP, ecs.SourcePrefix)
+		}
+	}
+	return key
+}
+
+// do calls fn once for concurrent identical req, the others wait for the result.
+// fn runs on a context detached from the callers,
+// so the query goes on if the first caller leaves.
+func (g *flightGroup) do(
+	ctx context.Context, name string, key string, req *dm.Message, fn func(ctx context.Context) (*dm.Message, error)) (
+	*dm.Message, error) {
+
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	call, ok := g.calls[key]
+	if ok {
+		statAdd("singleflight."+name+".shared", 1)
+		ctxlog.Debugf(ctx, "wait for in-flight query [key:%s]", key)
+	} else {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go g.call(ctx, key, call, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return call.result(req)
+}
+
+func (g *flightGroup) call(
+	ctx context.Context, key string, call *flightCall, fn func(ctx context.Context) (*dm.Message, error)) {
+
+	childCtx, cancel := detachContext(ctx, flightTimeout)
+	defer cancel()
+	call.res, call.err = fn(childCtx)
+	if call.res != nil {
+		if data, err := call.res.Pack(); err == nil {
+			call.data = data
+		}
+	}
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+}
+
+// a deep copy for each caller, the shared reply is never modified
+func (c *flightCall) result(req *dm.Message) (*dm.Message, error) {
+	if c.res == nil {
+		return nil, c.err
+	}
+	res := &dm.Message{}
+	if c.data == nil || res.Unpack(c.data) != nil {
+		res = copyMessage(c.res) // can not pack, the bodies are shared
+	}
+	res.ID = req.ID
+	res.Questions = append([]dm.Question(nil), req.Questions...)
+	return res, c.err
+}
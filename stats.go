@@ -0,0 +1,22 @@
+package dnsproxy
+
+import (
+	"expvar"
+)
+
+// Stats are served on /debug/vars by the debug server.
+var Stats = expvar.NewMap("dnsproxy")
+
+func statAdd(key string, delta int64) {
+	Stats.Add(key, delta)
+}
+
+func statSet(key string, value int64) {
+	if v, ok := Stats.Get(key).(*expvar.Int); ok {
+		v.Set(value)
+		return
+	}
+	v := new(expvar.Int)
+	v.Set(value)
+	Stats.Set(key, v)
+}
@@ -0,0 +1,235 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/account-login/ctxlog"
+	"github.com/pkg/errors"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// TCPResolver speaks RFC 7766 to a single upstream, or RFC 7858 if TLSConfig is set.
+// Queries are pipelined over one persistent connection and matched by txid.
+type TCPResolver struct {
+	Remote    string
+	Name      string
+	TLSConfig *tls.Config
+	// private
+	mu   sync.Mutex
+	conn *tcpConn
+	txid uint32
+	once sync.Once
+}
+
+var errConnClosed = errors.New("connection closed")
+
+type tcpConn struct {
+	conn    net.Conn
+	wmu     sync.Mutex
+	txid2ch sync.Map
+	once    sync.Once
+	closed  chan struct{}
+	// set before closed is closed
+	err error
+}
+
+func (r *TCPResolver) GetName() string {
+	return r.Name
+}
+
+func (r *TCPResolver) logPrefix() string {
+	proto := "TCP"
+	if r.TLSConfig != nil {
+		proto = "DoT"
+	}
+	return fmt.Sprintf("[%s:%v][remote:%v]", proto, r.Name, r.Remote)
+}
+
+func (r *TCPResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message, error) {
+	ctx = ctxlog.Push(ctx, r.logPrefix())
+
+	// the server may close an idle connection at any time,
+	// retry once on a fresh connection if it is gone.
+	for retry := 0; ; retry++ {
+		c, err := r.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := r.resolveOn(ctx, c, req)
+		if err == errConnClosed && retry == 0 {
+			ctxlog.Debugf(ctx, "conn closed: %v, retry", c.err)
+			continue
+		}
+		return res, err
+	}
+}
+
+func (r *TCPResolver) getConn(ctx context.Context) (*tcpConn, error) {
+	r.once.Do(func() {
+		var buf [4]byte
+		_, _ = rand.Read(buf[:])
+		r.txid = binary.LittleEndian.Uint32(buf[:])
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != nil {
+		select {
+		case <-r.conn.closed:
+			r.conn = nil
+		default:
+			return r.conn, nil
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if r.TLSConfig != nil {
+		dialer := tls.Dialer{Config: r.TLSConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", r.Remote)
+	} else {
+		dialer := net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", r.Remote)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+	ctxlog.Debugf(ctx, "connected [local:%v]", conn.LocalAddr())
+
+	r.conn = &tcpConn{conn: conn, closed: make(chan struct{})}
+	go r.readLoop(ctxlog.Push(context.Background(), r.logPrefix()), r.conn)
+	return r.conn, nil
+}
+
+func (r *TCPResolver) readLoop(ctx context.Context, c *tcpConn) {
+	ctx = ctxlog.Pushf(ctx, "[reader][local:%v]", c.conn.LocalAddr())
+
+	rbuf := bufio.NewReaderSize(c.conn, 64*1024)
+	buf := make([]byte, 64*1024)
+	for {
+		// read len field
+		_, err := io.ReadFull(rbuf, buf[:2])
+		if err != nil {
+			c.close(err)
+			break
+		}
+
+		// read body
+		length := binary.BigEndian.Uint16(buf[:2])
+		_, err = io.ReadFull(rbuf, buf[:length])
+		if err != nil {
+			c.close(err)
+			break
+		}
+
+		// parse
+		m := &dm.Message{}
+		err = m.Unpack(buf[:length])
+		if err != nil {
+			ctxlog.Warnf(ctx, "TCPResolver Unpack: %v", err)
+			continue
+		}
+
+		// post
+		if v, ok := c.txid2ch.Load(m.ID); ok {
+			ctxlog.Debugf(ctx, "got msg %v", ReprMessageShort(m))
+			select {
+			case v.(chan *dm.Message) <- m:
+				// pass
+			default:
+				ctxlog.Errorf(ctx, "channel for [txid:%v] full", m.ID)
+			}
+		} else {
+			ctxlog.Warnf(ctx, "unknown [txid:%v] %v", m.ID, ReprMessageShort(m))
+		}
+	}
+
+	ctxlog.Debugf(ctx, "conn closed: %v", c.err)
+}
+
+func (c *tcpConn) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
+
+func (r *TCPResolver) resolveOn(ctx context.Context, c *tcpConn, req *dm.Message) (*dm.Message, error) {
+	// txid
+	txid := uint16(atomic.AddUint32(&r.txid, 1))
+	originID := req.ID
+
+	// listen for ID
+	ch := make(chan *dm.Message, 1)
+	c.txid2ch.Store(txid, ch)
+	defer c.txid2ch.Delete(txid)
+
+	// pack request with length field
+	newReq := *req
+	newReq.ID = txid
+	buf, err := newReq.AppendPack(make([]byte, 2, 514))
+	if err != nil {
+		return nil, errors.Wrap(err, "req.Pack()")
+	}
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(buf)-2))
+
+	// send request
+	c.wmu.Lock()
+	select {
+	case <-c.closed:
+		c.wmu.Unlock()
+		return nil, errConnClosed
+	default:
+	}
+	deadline, _ := ctx.Deadline()
+	_ = c.conn.SetWriteDeadline(deadline)
+	_, err = c.conn.Write(buf)
+	c.wmu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, errors.Wrap(err, "conn.Write()")
+	}
+
+	// wait for response
+	select {
+	case <-ctx.Done():
+		ctxlog.Debugf(ctx, "abandoned: %v", ctx.Err())
+		return nil, ctx.Err()
+	case <-c.closed:
+		select {
+		case res := <-ch:
+			res.ID = originID
+			return res, nil
+		default:
+			return nil, errConnClosed
+		}
+	case res := <-ch:
+		// modify ID
+		res.ID = originID
+		return res, nil
+	}
+}
+
+// Close drops the current connection, a new one is made on the next query.
+func (r *TCPResolver) Close() error {
+	r.mu.Lock()
+	c := r.conn
+	r.conn = nil
+	r.mu.Unlock()
+
+	if c != nil {
+		c.close(errConnClosed)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package dnsproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	caCert, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, errors.Errorf("no cert found in %q", path)
+	}
+	return caCertPool, nil
+}
+
+// TLSClientConfig is the tls knobs for encrypted upstreams.
+type TLSClientConfig struct {
+	ServerName string
+	// PEM file, use system roots if empty
+	CAFile string
+	// base64 of sha256 of SubjectPublicKeyInfo, as in RFC 7858 section 4.2
+	SPKIPins []string
+	// client cert, optional
+	CertFile string
+	KeyFile  string
+}
+
+func (c *TLSClientConfig) Make() (*tls.Config, error) {
+	tlsConf := &tls.Config{ServerName: c.ServerName}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load ca file")
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client cert")
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.SPKIPins) > 0 {
+		pins := map[[sha256.Size]byte]bool{}
+		for _, pin := range c.SPKIPins {
+			raw, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(raw) != sha256.Size {
+				return nil, errors.Errorf("bad spki pin: %q", pin)
+			}
+			var key [sha256.Size]byte
+			copy(key[:], raw)
+			pins[key] = true
+		}
+
+		// called after the normal chain verification
+		tlsConf.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("no spki pin matched")
+		}
+	}
+
+	return tlsConf, nil
+}
+
+// CertReloader picks up renewed cert and key files without restart.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	// private
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (c *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.CertFile, c.KeyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Load reloads the files if they were modified.
+func (c *CertReloader) Load() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Now()
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err // keep the old one
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate is for tls.Config.GetCertificate, files are checked at most every 10s.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	stale := time.Since(c.checked) > 10*time.Second
+	c.mu.Unlock()
+
+	if stale {
+		if err := c.Load(); err != nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.cert == nil {
+				return nil, err
+			}
+			return c.cert, nil
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
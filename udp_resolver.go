@@ -8,30 +8,87 @@ import (
 	"github.com/pkg/errors"
 	dm "golang.org/x/net/dns/dnsmessage"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type UDPResolver struct {
 	// params
 	Local string
+	// number of sockets, each on a random port picked by the os.
+	// only 1 socket if Local has a port.
+	PoolSize int
+	// advertise this udp payload size to upstreams if not 0
+	EDNSUDPSize int
+	// a socket is replaced by a new one on another random port
+	// after MaxSocketQueries queries or MaxSocketAge, 0 to disable
+	MaxSocketQueries int
+	MaxSocketAge     time.Duration
 	// private
-	conn    net.PacketConn
-	txid    uint32
-	txid2ch sync.Map
+	mu      sync.Mutex
+	socks   []*udpSocket
+	retired map[*udpSocket]struct{}
 	quit    int32
-	exited  chan struct{}
+	exited  sync.WaitGroup
+}
+
+type udpSocket struct {
+	conn    net.PacketConn
+	pending sync.Map // txid -> *udpPending
+	// for rotation
+	created   time.Time
+	queries   int
+	inflight  int32
+	retired   int32
+	closeOnce sync.Once
+}
+
+// a query waiting for reply
+type udpPending struct {
+	remote *net.UDPAddr
+	// the question actually sent
+	q dm.Question
+	// compare the name in reply case sensitively, for 0x20
+	exactCase bool
+	ch        chan *dm.Message
+}
+
+// UDPQueryOptions are the per upstream options for UDPResolver.Resolve
+type UDPQueryOptions struct {
+	// resend the query after these delays since the first send
+	Retransmit []time.Duration
+	// randomize the case of query name and verify it in reply
+	Use0x20 bool
+	// stats are keyed by StatName if not empty
+	StatName string
 }
 
 type RemoteBindedUDPResolver struct {
 	Remote *net.UDPAddr
 	*UDPResolver
 	Name string
+	// for truncated reply, optional
+	TCP *TCPResolver
+	UDPQueryOptions
 }
 
 func (r *RemoteBindedUDPResolver) Resolve(ctx context.Context, req *dm.Message) (*dm.Message, error) {
 	ctx = ctxlog.Pushf(ctx, "[UDP:%v][remote:%v]", r.Name, r.Remote)
-	return r.UDPResolver.Resolve(ctx, r.Remote, req)
+	res, err := r.UDPResolver.Resolve(ctx, r.Remote, req, &r.UDPQueryOptions)
+	if err != nil || !res.Truncated || r.TCP == nil {
+		return res, err
+	}
+
+	// ask the same upstream again over tcp
+	ctxlog.Debugf(ctx, "truncated reply, retry with tcp")
+	tcpRes, err := r.TCP.Resolve(ctx, req)
+	if err != nil {
+		ctxlog.Warnf(ctx, "tcp retry: %v", err)
+		return res, nil // the truncated reply is better than nothing
+	}
+	return tcpRes, nil
 }
 
 func (r *RemoteBindedUDPResolver) GetName() string {
@@ -43,115 +100,330 @@ func (r *UDPResolver) Start() error {
 	if r.Local == "" {
 		r.Local = ":0"
 	}
-	conn, err := net.ListenPacket("udp", r.Local)
+	poolSize := r.PoolSize
+	if !r.randomPort() || poolSize < 1 {
+		poolSize = 1
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retired = map[*udpSocket]struct{}{}
+	for i := 0; i < poolSize; i++ {
+		sock, err := newUDPSocket(r.Local)
+		if err != nil {
+			for _, sock := range r.socks {
+				_ = sock.conn.Close()
+			}
+			r.socks = nil
+			return err
+		}
+		r.socks = append(r.socks, sock)
+	}
+
+	// reader loops
+	for _, sock := range r.socks {
+		r.exited.Add(1)
+		go r.readLoop(sock)
+	}
+
+	return nil
+}
+
+// sockets are rotated only if the os picks the port
+func (r *UDPResolver) randomPort() bool {
+	_, port, err := net.SplitHostPort(r.Local)
+	return err == nil && port == "0"
+}
+
+func newUDPSocket(local string) (*udpSocket, error) {
+	conn, err := net.ListenPacket("udp", local)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	r.conn = conn
+	return &udpSocket{conn: conn, created: time.Now()}, nil
+}
 
-	// init txid
-	var buf [4]byte
-	_, _ = rand.Read(buf[:])
-	r.txid = binary.LittleEndian.Uint32(buf[:])
+// with lock
+func (r *UDPResolver) shouldRotate(sock *udpSocket) bool {
+	if !r.randomPort() {
+		return false
+	}
+	return (r.MaxSocketQueries > 0 && sock.queries >= r.MaxSocketQueries) ||
+		(r.MaxSocketAge > 0 && time.Since(sock.created) >= r.MaxSocketAge)
+}
 
-	// init channels
-	r.exited = make(chan struct{}, 0)
+// replace the socket at idx with a new one, with lock.
+// the old one is closed after its queries are done.
+func (r *UDPResolver) rotate(ctx context.Context, idx int) {
+	sock, err := newUDPSocket(r.Local)
+	if err != nil {
+		ctxlog.Warnf(ctx, "rotate udp socket: %v", err)
+		return
+	}
+	old := r.socks[idx]
+	r.socks[idx] = sock
+	r.exited.Add(1)
+	go r.readLoop(sock)
+	statAdd("udp.socket_rotated", 1)
+	ctxlog.Debugf(ctx, "rotate udp socket %v -> %v", old.conn.LocalAddr(), sock.conn.LocalAddr())
 
-	// reader loop
-	go func() {
-		defer close(r.exited)
+	r.retired[old] = struct{}{}
+	atomic.StoreInt32(&old.retired, 1)
+	if atomic.LoadInt32(&old.inflight) == 0 {
+		old.close()
+	}
+}
 
-		session := 0
-		buf := make([]byte, 64*1024)
-		for {
-			session += 1
-			ctx := ctxlog.Pushf(context.Background(), "[reader:%v]", session)
+func (sock *udpSocket) close() {
+	sock.closeOnce.Do(func() {
+		_ = sock.conn.Close()
+	})
+}
 
-			// read
-			n, addr, err := conn.ReadFrom(buf)
-			if err != nil {
-				ctxlog.Errorf(ctx, "UDPResolver ReadFrom: %v", err)
-				if atomic.LoadInt32(&r.quit) != 0 {
-					break
-				} else {
-					continue
-				}
-			}
+// a query on sock is done
+func (r *UDPResolver) release(sock *udpSocket) {
+	if atomic.AddInt32(&sock.inflight, -1) == 0 && atomic.LoadInt32(&sock.retired) != 0 {
+		sock.close()
+	}
+}
 
-			// parse
-			m := &dm.Message{}
-			err = m.Unpack(buf[:n])
-			if err != nil {
-				ctxlog.Warnf(ctx, "UDPResolver Unpack: %v", err)
-				continue
-			}
+func (r *UDPResolver) readLoop(sock *udpSocket) {
+	defer r.exited.Done()
+	defer func() {
+		r.mu.Lock()
+		delete(r.retired, sock)
+		r.mu.Unlock()
+	}()
 
-			// post
-			if v, ok := r.txid2ch.Load(m.ID); ok {
-				ctxlog.Debugf(ctx, "got msg from [remote:%v] %v", addr, ReprMessageShort(m))
-				ch := v.(chan *dm.Message)
-				select {
-				case ch <- m:
-					// pass
-				default:
-					ctxlog.Errorf(ctx, "channel for [txid:%v] full. [remote:%v]", m.ID, addr)
-				}
+	session := 0
+	buf := make([]byte, 64*1024)
+	for {
+		session += 1
+		ctx := ctxlog.Pushf(context.Background(), "[reader:%v][local:%v]", session, sock.conn.LocalAddr())
+
+		// read
+		n, addr, err := sock.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) &&
+				(atomic.LoadInt32(&r.quit) != 0 || atomic.LoadInt32(&sock.retired) != 0) {
+				break
+			}
+			ctxlog.Errorf(ctx, "UDPResolver ReadFrom: %v", err)
+			if atomic.LoadInt32(&r.quit) != 0 {
+				break
 			} else {
-				ctxlog.Warnf(ctx, "unknown [txid:%v] from [remote:%v] %v",
-					m.ID, addr, ReprMessageShort(m))
 				continue
 			}
 		}
-	}()
 
-	return nil
+		// parse
+		m := &dm.Message{}
+		err = m.Unpack(buf[:n])
+		if err != nil {
+			ctxlog.Warnf(ctx, "UDPResolver Unpack: %v", err)
+			continue
+		}
+
+		// post
+		v, ok := sock.pending.Load(m.ID)
+		if !ok {
+			ctxlog.Warnf(ctx, "unknown [txid:%v] from [remote:%v] %v",
+				m.ID, addr, ReprMessageShort(m))
+			continue
+		}
+		p := v.(*udpPending)
+		if !udpAddrEqual(addr, p.remote) {
+			statAdd("udp.bad_source", 1)
+			ctxlog.Warnf(ctx, "[txid:%v] from unexpected [remote:%v], expect [remote:%v] %v",
+				m.ID, addr, p.remote, ReprMessageShort(m))
+			continue
+		}
+		if len(m.Questions) != 1 || !questionMatch(&m.Questions[0], &p.q, p.exactCase) {
+			statAdd("udp.bad_question", 1)
+			ctxlog.Warnf(ctx, "[txid:%v] question mismatch from [remote:%v], expect %v %v",
+				m.ID, addr, ReprQuestionShort(&p.q), ReprMessageShort(m))
+			continue
+		}
+
+		ctxlog.Debugf(ctx, "got msg from [remote:%v] %v", addr, ReprMessageShort(m))
+		select {
+		case p.ch <- m:
+			// pass
+		default:
+			// a reply was delivered already, duplicated by retransmits
+			ctxlog.Debugf(ctx, "duplicated reply for [txid:%v] from [remote:%v]", m.ID, addr)
+		}
+	}
+}
+
+func questionMatch(a *dm.Question, b *dm.Question, exactCase bool) bool {
+	if a.Type != b.Type || a.Class != b.Class {
+		return false
+	}
+	if exactCase {
+		return a.Name == b.Name
+	}
+	return strings.EqualFold(a.Name.String(), b.Name.String())
+}
+
+func udpAddrEqual(addr net.Addr, remote *net.UDPAddr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	return ok && ua.Port == remote.Port && ua.IP.Equal(remote.IP)
 }
 
 func (r *UDPResolver) Stop() {
 	atomic.StoreInt32(&r.quit, 1)
-	_ = r.conn.Close()
-	r.txid2ch.Range(func(key, value interface{}) bool { r.txid2ch.Delete(key); return true })
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sock := range r.socks {
+		sock.close()
+		sock.pending.Range(func(key, value interface{}) bool { sock.pending.Delete(key); return true })
+	}
+	for sock := range r.retired {
+		sock.close()
+	}
 }
 
 func (r *UDPResolver) Wait() {
-	<-r.exited
+	r.exited.Wait()
+}
+
+func randUint32() uint32 {
+	var buf [4]byte
+	_, _ = rand.Read(buf[:])
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+// pick a random socket and a random txid not in use by the socket.
+// call release(sock) when done.
+func (r *UDPResolver) register(ctx context.Context, p *udpPending) (*udpSocket, uint16, error) {
+	r.mu.Lock()
+	idx := int(randUint32() % uint32(len(r.socks)))
+	if r.shouldRotate(r.socks[idx]) {
+		r.rotate(ctx, idx)
+	}
+	sock := r.socks[idx]
+	sock.queries++
+	atomic.AddInt32(&sock.inflight, 1)
+	r.mu.Unlock()
+
+	for i := 0; i < 16; i++ {
+		txid := uint16(randUint32())
+		if _, loaded := sock.pending.LoadOrStore(txid, p); !loaded {
+			return sock, txid, nil
+		}
+	}
+	r.release(sock)
+	return nil, 0, errors.New("can not allocate txid")
+}
+
+// randomize the case of letters, DNS 0x20
+func randomizeCase(name dm.Name) dm.Name {
+	var bits [32]byte
+	_, _ = rand.Read(bits[:])
+	for i := 0; i < int(name.Length); i++ {
+		c := name.Data[i]
+		isLetter := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+		if isLetter && bits[i/8]&(1<<(i%8)) != 0 {
+			name.Data[i] = c ^ 0x20
+		}
+	}
+	return name
+}
+
+// undo the 0x20 case randomization for names in reply
+func restoreCase(res *dm.Message, sent dm.Name, origin dm.Name) {
+	for i := range res.Questions {
+		res.Questions[i].Name = origin
+	}
+	for _, section := range [][]dm.Resource{res.Answers, res.Authorities, res.Additionals} {
+		for i := range section {
+			if section[i].Header.Name == sent {
+				section[i].Header.Name = origin
+			}
+		}
+	}
 }
 
 func (r *UDPResolver) Resolve(
-	ctx context.Context, remote *net.UDPAddr, req *dm.Message) (
+	ctx context.Context, remote *net.UDPAddr, req *dm.Message, opts *UDPQueryOptions) (
 	*dm.Message, error) {
 
-	// txid
-	txid := uint16(atomic.AddUint32(&r.txid, 1))
+	if len(req.Questions) != 1 {
+		return nil, errors.New("expect exactly 1 question")
+	}
 	originID := req.ID
 
+	// the question to send
+	q := req.Questions[0]
+	if opts.Use0x20 {
+		q.Name = randomizeCase(q.Name)
+	}
+
 	// listen for ID
-	ch := make(chan *dm.Message, 1)
-	r.txid2ch.Store(txid, ch)
-	defer r.txid2ch.Delete(txid)
+	p := &udpPending{remote: remote, q: q, exactCase: opts.Use0x20, ch: make(chan *dm.Message, 1)}
+	sock, txid, err := r.register(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(sock)
+	defer sock.pending.Delete(txid)
 
 	// send request
 	newReq := *req
 	newReq.ID = txid
+	newReq.Questions = []dm.Question{q}
+	if r.EDNSUDPSize > 0 {
+		newReq.Additionals = withUpstreamOPT(req, r.EDNSUDPSize)
+	}
 	buf, err := newReq.Pack()
 	if err != nil {
 		return nil, errors.Wrap(err, "req.Pack()")
 	}
-	_, err = r.conn.WriteTo(buf, remote)
+	_, err = sock.conn.WriteTo(buf, remote)
 	if err != nil {
 		return nil, errors.Wrap(err, "r.conn.WriteTo()")
 	}
+	start := time.Now()
 
-	// TODO: retry
+	// retransmit timer
+	retries := 0
+	var timer <-chan time.Time
+	if len(opts.Retransmit) > 0 {
+		timer = time.After(opts.Retransmit[0])
+	}
 
 	// wait for response
-	select {
-	case <-ctx.Done():
-		ctxlog.Debugf(ctx, "abandoned: %v", ctx.Err())
-		return nil, ctx.Err()
-	case res := <-ch:
-		// modify ID
-		res.ID = originID
-		return res, nil
+	for {
+		select {
+		case <-ctx.Done():
+			ctxlog.Debugf(ctx, "abandoned: %v", ctx.Err())
+			return nil, ctx.Err()
+		case <-timer:
+			// same txid, any reply will do
+			retries++
+			ctxlog.Debugf(ctx, "[retry:%v] retransmit", retries)
+			if opts.StatName != "" {
+				statAdd("udp."+opts.StatName+".retransmit", 1)
+			}
+			_, err = sock.conn.WriteTo(buf, remote)
+			if err != nil {
+				ctxlog.Warnf(ctx, "retransmit: %v", err)
+			}
+			timer = nil
+			if retries < len(opts.Retransmit) {
+				timer = time.After(opts.Retransmit[retries] - time.Since(start))
+			}
+		case res := <-p.ch:
+			if retries > 0 && opts.StatName != "" {
+				statAdd("udp."+opts.StatName+".rescued", 1)
+			}
+			if opts.Use0x20 {
+				restoreCase(res, q.Name, req.Questions[0].Name)
+			}
+			// modify ID
+			res.ID = originID
+			return res, nil
+		}
 	}
 }
@@ -0,0 +1,207 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"expvar"
+	dm "golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUDP is an upstream on addr, no reply if h returns nil
+func fakeUDP(t *testing.T, addr string, h func(*dm.Message) *dm.Message) (*net.UDPAddr, func()) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, remote, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := &dm.Message{}
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			if res := h(req); res != nil {
+				out, _ := res.Pack()
+				_, _ = conn.WriteTo(out, remote)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr), func() { _ = conn.Close() }
+}
+
+// fakeTCP is a tcp upstream on a random port, the conn is closed if h returns nil
+func fakeTCP(t *testing.T, h func(*dm.Message) *dm.Message) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				buf := make([]byte, 65536)
+				for {
+					if _, err := io.ReadFull(reader, buf[:2]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint16(buf[:2])
+					if _, err := io.ReadFull(reader, buf[:n]); err != nil {
+						return
+					}
+					req := &dm.Message{}
+					if err := req.Unpack(buf[:n]); err != nil {
+						return
+					}
+					res := h(req)
+					if res == nil {
+						return
+					}
+					out, _ := res.AppendPack(make([]byte, 2))
+					binary.BigEndian.PutUint16(out, uint16(len(out)-2))
+					if _, err := conn.Write(out); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), func() { _ = listener.Close() }
+}
+
+func startUDPResolver(t *testing.T) *UDPResolver {
+	r := &UDPResolver{Local: "127.0.0.1:0"}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestUDPTruncatedRetryTCP(t *testing.T) {
+	// udp and tcp on the same port
+	tcpAddr, stopTCP := fakeTCP(t, func(req *dm.Message) *dm.Message {
+		res := mkA(req, [4]byte{5, 5, 5, 5}, 60)
+		rr := res.Answers[0]
+		rr.Body = &dm.AResource{A: [4]byte{5, 5, 5, 6}}
+		res.Answers = append(res.Answers, rr)
+		return res
+	})
+	defer stopTCP()
+	var udpQueries int32
+	udpAddr, stopUDP := fakeUDP(t, tcpAddr, func(req *dm.Message) *dm.Message {
+		atomic.AddInt32(&udpQueries, 1)
+		res := mkA(req, [4]byte{1, 1, 1, 1}, 60)
+		res.Truncated = true
+		return res
+	})
+	defer stopUDP()
+
+	u := startUDPResolver(t)
+	defer u.Stop()
+	tcp := &TCPResolver{Name: "tc", Remote: tcpAddr}
+	defer tcp.Close()
+	r := &RemoteBindedUDPResolver{Remote: udpAddr, UDPResolver: u, Name: "tc", TCP: tcp}
+	cache := &CacheResolver{Name: "tc", Child: r}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req := mkReq("big.example.", dm.TypeA)
+	res, err := r.Resolve(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Truncated || len(res.Answers) != 2 || res.ID != req.ID {
+		t.Fatalf("not the tcp answer: %v", ReprMessageShort(res))
+	}
+
+	// the truncated reply is not cached even without the tcp retry
+	r.TCP = nil
+	res, err = cache.Resolve(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Truncated {
+		t.Fatalf("should be the udp answer: %v", ReprMessageShort(res))
+	}
+	if _, ok := cache.get(ctx, req); ok {
+		t.Fatal("truncated reply cached")
+	}
+
+	// the complete answer is cached
+	r.TCP = tcp
+	if res, err = cache.Resolve(ctx, req); err != nil || res.Truncated {
+		t.Fatal(res, err)
+	}
+	cached, ok := cache.get(ctx, req)
+	if !ok || cached.Truncated || len(cached.Answers) != 2 {
+		t.Fatal("complete answer not cached")
+	}
+	if n := atomic.LoadInt32(&udpQueries); n != 3 {
+		t.Fatalf("udp queries: %v", n)
+	}
+}
+
+func statValue(key string) int64 {
+	if v, ok := Stats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	var received int32
+	addr, stop := fakeUDP(t, "127.0.0.1:0", func(req *dm.Message) *dm.Message {
+		if atomic.AddInt32(&received, 1) == 1 {
+			return nil // dropped
+		}
+		return mkA(req, [4]byte{1, 2, 3, 4}, 60)
+	})
+	defer stop()
+
+	u := startUDPResolver(t)
+	defer u.Stop()
+	retransmit := 50 * time.Millisecond
+	r := &RemoteBindedUDPResolver{Remote: addr, UDPResolver: u, Name: "rt", UDPQueryOptions: UDPQueryOptions{
+		Retransmit: []time.Duration{retransmit}, StatName: "rt",
+	}}
+	retransmits, rescued := statValue("udp.rt.retransmit"), statValue("udp.rt.rescued")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req := mkReq("a.example.", dm.TypeA)
+	start := time.Now()
+	res, err := r.Resolve(ctx, req)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Answers) != 1 || res.ID != req.ID {
+		t.Fatalf("bad reply: %v", ReprMessageShort(res))
+	}
+	if elapsed < retransmit || elapsed > retransmit+500*time.Millisecond {
+		t.Fatalf("elapsed: %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Fatalf("received: %v", n)
+	}
+	if d := statValue("udp.rt.retransmit") - retransmits; d != 1 {
+		t.Fatalf("retransmit: %v", d)
+	}
+	if d := statValue("udp.rt.rescued") - rescued; d != 1 {
+		t.Fatalf("rescued: %v", d)
+	}
+}
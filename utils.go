@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/account-login/ctxlog"
 	"io"
+	"time"
 )
 
 func safeClose(ctx context.Context, closer io.Closer) {
@@ -11,3 +12,18 @@ func safeClose(ctx context.Context, closer io.Closer) {
 		ctxlog.Errorf(ctx, "close() error: %v", err)
 	}
 }
+
+// detachContext keeps the log prefix and client ip of ctx, but not its cancellation.
+// the deadline of ctx is kept if any, otherwise timeout is used.
+func detachContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var child context.Context
+	var cancel context.CancelFunc
+	if deadline, ok := ctx.Deadline(); ok {
+		child, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		child, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	child = ctxlog.Push(child, ctxlog.Ctx(ctx))
+	child = WithClientIP(child, ClientIPFromContext(ctx))
+	return child, cancel
+}